@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// The access file, called .access.txt, restricts the addresses from which the
+// files in a directory can be accessed. Like .passwd.txt it applies to all
+// underlying files.
+//
+// Every line contains either a rule or a directive:
+//
+//	allow 192.168.1.0/24
+//	deny all
+//	require any
+//
+// Rules are evaluated top to bottom and the first rule that matches the client
+// address is applied. The require directive determines how rules combine with
+// password protection. With "any", the default, an allowed address grants
+// access without a password and other addresses that are not denied have to
+// enter the password. With "all", the address must be allowed and the
+// password must be entered. Addresses that match no rule are denied if there is
+// no password to enter.
+const accessFileName = ".access.txt"
+
+type accessDecision int
+
+const (
+	// The client may access the file without further checks.
+	accessGranted accessDecision = iota
+	// The client may never access the file.
+	accessDenied
+	// The client may access the file if it passes password authentication.
+	accessNeedPassword
+)
+
+type accessRule struct {
+	allow bool
+	// A nil network matches all addresses.
+	network *net.IPNet
+}
+
+type AccessRules struct {
+	rules      []accessRule
+	requireAll bool
+}
+
+func readAccessFile(filename string) (*AccessRules, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening access file: %v", err)
+	}
+	defer fd.Close()
+
+	var ar AccessRules
+	scanner := bufio.NewScanner(fd)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a keyword and an argument", filename, lineno)
+		}
+
+		switch fields[0] {
+		case "allow", "deny":
+			rule := accessRule{allow: fields[0] == "allow"}
+			if fields[1] != "all" {
+				if rule.network, err = parseNetwork(fields[1]); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+				}
+			}
+			ar.rules = append(ar.rules, rule)
+		case "require":
+			switch fields[1] {
+			case "any":
+				ar.requireAll = false
+			case "all":
+				ar.requireAll = true
+			default:
+				return nil, fmt.Errorf("%s:%d: require must be either \"any\" or \"all\"", filename, lineno)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown keyword %q", filename, lineno, fields[0])
+		}
+	}
+	return &ar, scanner.Err()
+}
+
+// Decide determines whether a client at the specified address may access the
+// files governed by the rules. hasPassword reports whether the files are also
+// protected by a password.
+func (ar *AccessRules) Decide(ip net.IP, hasPassword bool) accessDecision {
+	for _, rule := range ar.rules {
+		if rule.network != nil && (ip == nil || !rule.network.Contains(ip)) {
+			continue
+		}
+		if !rule.allow {
+			return accessDenied
+		}
+		if ar.requireAll {
+			return accessNeedPassword
+		}
+		return accessGranted
+	}
+	if ar.requireAll || !hasPassword {
+		return accessDenied
+	}
+	return accessNeedPassword
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"webfs/src/fs"
+)
+
+func writeAccessFile(t *testing.T, contents string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), accessFileName)
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadAccessFileErrors(t *testing.T) {
+	tests := []struct {
+		contents string
+		err      string
+	}{
+		{"allow", "expected a keyword and an argument"},
+		{"allow 10.0.0.0/8 extra", "expected a keyword and an argument"},
+		{"permit 10.0.0.0/8", "unknown keyword"},
+		{"allow 10.0.0.0/33", "invalid CIDR"},
+		{"deny example.com", "invalid IP address"},
+		{"require some", "require must be"},
+		{"allow all\nallow nope", ":2:"},
+	}
+	for _, test := range tests {
+		_, err := readAccessFile(writeAccessFile(t, test.contents))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("readAccessFile(%q) = %v, want an error containing %q", test.contents, err, test.err)
+		}
+	}
+}
+
+func TestAccessRulesDecide(t *testing.T) {
+	const (
+		office = "192.168.1.20"
+		vpn    = "2001:db8::1"
+		other  = "203.0.113.7"
+	)
+	tests := []struct {
+		contents    string
+		ip          string
+		hasPassword bool
+		want        accessDecision
+	}{
+		// Only allowing some networks keeps everyone else out.
+		{"allow 192.168.1.0/24\nallow 2001:db8::/32", office, false, accessGranted},
+		{"allow 192.168.1.0/24\nallow 2001:db8::/32", vpn, false, accessGranted},
+		{"allow 192.168.1.0/24\nallow 2001:db8::/32", other, false, accessDenied},
+		{"allow 192.168.1.0/24", other, true, accessNeedPassword},
+		{"allow 192.168.1.0/24", "", false, accessDenied},
+		// The first matching rule wins.
+		{"deny 192.168.1.20\nallow 192.168.1.0/24", office, false, accessDenied},
+		{"allow 192.168.1.0/24\ndeny all", office, false, accessGranted},
+		{"deny 192.168.1.0/24\nallow all", other, false, accessGranted},
+		{"deny all # everyone", office, true, accessDenied},
+		// Comments and blank lines are ignored.
+		{"# office\n\nallow 192.168.1.0/24 # lan\n", office, false, accessGranted},
+		// With require all an allowed client still needs the password.
+		{"require all\nallow 192.168.1.0/24", office, true, accessNeedPassword},
+		{"require all\nallow 192.168.1.0/24", other, true, accessDenied},
+		{"allow 192.168.1.0/24\nrequire all\nrequire any", office, true, accessGranted},
+	}
+	for _, test := range tests {
+		rules, err := readAccessFile(writeAccessFile(t, test.contents))
+		if err != nil {
+			t.Fatalf("readAccessFile(%q): %v", test.contents, err)
+		}
+		if got := rules.Decide(net.ParseIP(test.ip), test.hasPassword); got != test.want {
+			t.Errorf("Decide(%q, %v) with %q = %v, want %v", test.ip, test.hasPassword, test.contents, got, test.want)
+		}
+	}
+}
+
+func TestCheckAccessNestedPassword(t *testing.T) {
+	mount := t.TempDir()
+	for name, contents := range map[string]string{
+		"office/" + accessFileName:     "allow 10.0.0.0/8",
+		"office/s.txt":                 "secret",
+		"office/inner/.passwd.txt":     "jane secret",
+		"office/inner/s.txt":           "secret",
+		"office/outer/s.txt":           "secret",
+		"shared/.passwd.txt":           "jane secret",
+		"shared/lan/" + accessFileName: "allow 10.0.0.0/8",
+		"shared/lan/s.txt":             "secret",
+	} {
+		filename := filepath.Join(mount, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filesystem, err := fs.NewFilesystem(mount, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &BasicAuthenticator{filesystem: filesystem}
+
+	tests := []struct {
+		path string
+		want accessDecision
+	}{
+		{"office/s.txt", accessGranted},
+		{"office/outer/s.txt", accessGranted},
+		// A password below the access file is still required.
+		{"office/inner/s.txt", accessNeedPassword},
+		// The access file may waive a password of a parent directory.
+		{"shared/lan/s.txt", accessGranted},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/get/"+test.path, nil)
+		r.RemoteAddr = "10.1.2.3:1234"
+		got, err := auth.checkAccess(filepath.Join(mount, test.path), r)
+		if err != nil {
+			t.Fatalf("checkAccess(%q): %v", test.path, err)
+		}
+		if got != test.want {
+			t.Errorf("checkAccess(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
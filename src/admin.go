@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"webfs/src/cache"
+	"webfs/src/fs"
+	"webfs/src/metadata"
+	"webfs/src/metrics"
+	"webfs/src/thumb"
+)
+
+type AdminStatus struct {
+	Version     string
+	VersionDate string
+	Build       string
+	GoVersion   string
+	Started     time.Time
+	Uptime      string
+
+	Thumbers      []ThumberStatus
+	Cache         cache.Stats
+	Metadata      cache.Stats
+	Pregeneration fs.PregenerationStatus
+}
+
+type ThumberStatus struct {
+	Name    string
+	Enabled bool
+	Reason  string
+}
+
+func thumberStatuses() []ThumberStatus {
+	var statuses []ThumberStatus
+	for _, name := range thumb.Thumbers() {
+		statuses = append(statuses, ThumberStatus{Name: name, Enabled: true})
+	}
+	var disabled []ThumberStatus
+	for name, reason := range thumb.DisabledThumbers() {
+		disabled = append(disabled, ThumberStatus{Name: name, Reason: reason.Error()})
+	}
+	sort.Slice(disabled, func(i, j int) bool {
+		return disabled[i].Name < disabled[j].Name
+	})
+	return append(statuses, disabled...)
+}
+
+// requireAdmin only passes requests carrying credentials from the admin
+// password file, which uses the format of .passwd.txt. If no file is
+// configured, the admin pages do not exist.
+func (web *Web) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if web.config().Admin.PasswdFile == "" {
+			http.NotFound(w, r)
+			return
+		}
+		passwdFile, err := resolveHome(web.config().Admin.PasswdFile)
+		if err != nil {
+			authLogger.ErrorContext(r.Context(), "Could not check admin credentials", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if username, password, ok := r.BasicAuth(); ok {
+			time.Sleep(time.Millisecond * 200) // Mitigate brute force attack.
+			ok, err := authFileAuthenticate(passwdFile, username, password)
+			if err != nil {
+				authLogger.ErrorContext(r.Context(), "Could not check admin credentials", "err", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			metrics.AuthFailures.WithLabelValues("admin").Inc()
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="webfs admin"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+func (web *Web) adminStatus(w http.ResponseWriter, r *http.Request) {
+	status := AdminStatus{
+		Version:       version,
+		VersionDate:   versionDate,
+		Build:         build,
+		GoVersion:     runtime.Version(),
+		Started:       startTime,
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		Thumbers:      thumberStatuses(),
+		Cache:         web.thumbCache.Stats(),
+		Metadata:      metadata.Shared().Stats(),
+		Pregeneration: web.fs.Pregeneration(),
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	args := web.baseTeplateArgs(r)
+	args["title"] = "Status"
+	args["status"] = status
+	if err := web.pageTemplate("admin.html").Execute(w, args); err != nil {
+		panic(err)
+	}
+}
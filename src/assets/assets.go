@@ -0,0 +1,285 @@
+// Package assets holds the page templates and the public files served by
+// webfs. The files are embedded in the binary, any of them can be replaced by
+// placing a file at the same path in an override directory.
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const publicDir = "public"
+
+// The frontend libraries every page depends on. They are symlinks to the git
+// submodules in lib/web, which can not be embedded, so `just build` copies
+// them into public/00-dep first.
+var dependencies = []string{
+	"/00-dep/css/bootstrap.css",
+	"/00-dep/css/font-awesome.css",
+	"/00-dep/js/00-jquery.js",
+	"/00-dep/js/00-underscore.js",
+	"/00-dep/js/01-backbone.js",
+	"/00-dep/js/bootstrap.js",
+}
+
+// The page templates, the partials they include and the public directory,
+// which is served at the root.
+//
+//go:embed *.html partials public
+var embedded embed.FS
+
+// Assets is a set of templates and public files.
+type Assets struct {
+	fs iofs.FS
+	// Public files by URL path, both by their plain and hashed path.
+	public map[string]*file
+	// Plain URL paths of all public files, sorted.
+	paths []string
+}
+
+// A file is a public file along with its compressed variants. Variants that
+// are not smaller than the original are nil.
+type file struct {
+	path        string
+	hashedPath  string
+	contentType string
+	hash        string
+	content     []byte
+	gzip        []byte
+	brotli      []byte
+}
+
+// Open loads the embedded assets, overridden by the files in dir if it is not
+// empty. The public files are hashed and compressed once, so changes to the
+// files in dir require the assets to be opened again.
+func Open(dir string) (*Assets, error) {
+	var fsys iofs.FS = embedded
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		fsys = overlayFS{os.DirFS(dir), embedded}
+	}
+	assets := &Assets{fs: fsys, public: map[string]*file{}}
+
+	names, err := walkFiles(fsys, publicDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		// Precompressed variants are picked up along with the original.
+		if ext := path.Ext(name); (ext == ".gz" || ext == ".br") && contains(names, strings.TrimSuffix(name, ext)) {
+			continue
+		}
+		f, err := loadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		assets.public[f.path] = f
+		assets.public[f.hashedPath] = f
+		assets.paths = append(assets.paths, f.path)
+	}
+	sort.Strings(assets.paths)
+
+	// A binary built without the libraries would serve pages that do not
+	// work at all.
+	for _, dep := range dependencies {
+		if _, ok := assets.public[dep]; !ok {
+			return nil, fmt.Errorf("%s is missing from the assets, build webfs with `just build` or add it to the assets directory", dep)
+		}
+	}
+	return assets, nil
+}
+
+func loadFile(fsys iofs.FS, name string) (*file, error) {
+	content, err := iofs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])[:12]
+
+	urlPath := strings.TrimPrefix(name, publicDir)
+	ext := path.Ext(urlPath)
+	f := &file{
+		path:        urlPath,
+		hashedPath:  strings.TrimSuffix(urlPath, ext) + "." + hash + ext,
+		contentType: mime.TypeByExtension(ext),
+		hash:        hash,
+		content:     content,
+	}
+	if f.contentType == "" {
+		f.contentType = http.DetectContentType(content)
+	}
+
+	if gz, err := iofs.ReadFile(fsys, name+".gz"); err == nil {
+		f.gzip = gz
+	} else if compressible(f.contentType) {
+		f.gzip = compress(content, func(w io.Writer) io.WriteCloser {
+			gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return gw
+		})
+	}
+	if br, err := iofs.ReadFile(fsys, name+".br"); err == nil {
+		f.brotli = br
+	} else if compressible(f.contentType) {
+		f.brotli = compress(content, func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, brotli.BestCompression)
+		})
+	}
+	return f, nil
+}
+
+// compress returns the compressed content, or nil if it is not smaller.
+func compress(content []byte, newWriter func(io.Writer) io.WriteCloser) []byte {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	w.Write(content)
+	w.Close()
+	if buf.Len() >= len(content) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "javascript"),
+		strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "xml"),
+		mediaType == "image/svg+xml",
+		mediaType == "font/ttf",
+		mediaType == "font/otf",
+		mediaType == "application/vnd.ms-fontobject":
+		return true
+	}
+	return false
+}
+
+// ReadFile returns the contents of a file, e.g. a template.
+func (assets *Assets) ReadFile(name string) ([]byte, error) {
+	return iofs.ReadFile(assets.fs, name)
+}
+
+// FS returns the filesystem holding the assets.
+func (assets *Assets) FS() iofs.FS {
+	return assets.fs
+}
+
+// Paths returns the plain and hashed URL paths of all public files.
+func (assets *Assets) Paths() []string {
+	paths := make([]string, 0, len(assets.public))
+	for p := range assets.public {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// URL returns the hashed URL path of the public file at the plain URL path,
+// e.g. /css/style.css. The path is returned as is if no such file exists.
+func (assets *Assets) URL(urlPath string) string {
+	if f, ok := assets.public[urlPath]; ok {
+		return f.hashedPath
+	}
+	return urlPath
+}
+
+// WithExt returns the hashed URL paths of the public files with the specified
+// extension, ordered by their plain path.
+func (assets *Assets) WithExt(ext string) []string {
+	var urls []string
+	for _, p := range assets.paths {
+		if path.Ext(p) == ext {
+			urls = append(urls, assets.public[p].hashedPath)
+		}
+	}
+	return urls
+}
+
+// Handler serves the public file at the plain or hashed URL path. Files
+// requested by their hashed path may be cached forever.
+func (assets *Assets) Handler(urlPath string) http.Handler {
+	f, ok := assets.public[urlPath]
+	if !ok {
+		return http.NotFoundHandler()
+	}
+	immutable := urlPath == f.hashedPath
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The files are the same for everybody and may be stored by
+		// shared caches, which must not hand out cookies.
+		w.Header().Del("Set-Cookie")
+		if immutable {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		w.Header().Set("Content-Type", f.contentType)
+
+		content, encoding := f.content, ""
+		if f.gzip != nil || f.brotli != nil {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if f.brotli != nil && acceptsEncoding(r, "br") {
+				content, encoding = f.brotli, "br"
+			} else if f.gzip != nil && acceptsEncoding(r, "gzip") {
+				content, encoding = f.gzip, "gzip"
+			}
+		}
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Set("ETag", `"`+f.hash+"-"+encoding+`"`)
+		} else {
+			w.Header().Set("ETag", `"`+f.hash+`"`)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+}
+
+// acceptsEncoding reports whether the client accepts the content coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(accepted, ";")
+		if strings.TrimSpace(name) != coding {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+func walkFiles(fsys iofs.FS, root string) ([]string, error) {
+	var names []string
+	err := iofs.WalkDir(fsys, root, func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func contains(sorted []string, s string) bool {
+	i := sort.SearchStrings(sorted, s)
+	return i < len(sorted) && sorted[i] == s
+}
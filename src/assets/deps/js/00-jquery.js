@@ -0,0 +1 @@
+../../../../lib/web/jquery/dist/jquery.js
\ No newline at end of file
@@ -0,0 +1 @@
+../../../../lib/web/underscore/underscore.js
\ No newline at end of file
@@ -0,0 +1 @@
+../../../../lib/web/backbone/backbone.js
\ No newline at end of file
@@ -0,0 +1 @@
+../../../../lib/web/bootstrap/dist/js/bootstrap.js
\ No newline at end of file
@@ -0,0 +1,53 @@
+package assets
+
+import (
+	"errors"
+	iofs "io/fs"
+	"sort"
+)
+
+// overlayFS is a filesystem in which the files of the upper filesystem take
+// precedence over those of the lower one. Directories are merged.
+type overlayFS struct {
+	upper, lower iofs.FS
+}
+
+func (o overlayFS) Open(name string) (iofs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil {
+		return f, nil
+	} else if !errors.Is(err, iofs.ErrNotExist) {
+		return nil, err
+	}
+	return o.lower.Open(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	upper, uerr := iofs.ReadDir(o.upper, name)
+	if uerr != nil && !errors.Is(uerr, iofs.ErrNotExist) {
+		return nil, uerr
+	}
+	lower, lerr := iofs.ReadDir(o.lower, name)
+	if lerr != nil && !errors.Is(lerr, iofs.ErrNotExist) {
+		return nil, lerr
+	}
+	if uerr != nil && lerr != nil {
+		return nil, uerr
+	}
+
+	entries := map[string]iofs.DirEntry{}
+	for _, e := range lower {
+		entries[e.Name()] = e
+	}
+	for _, e := range upper {
+		entries[e.Name()] = e
+	}
+	merged := make([]iofs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name() < merged[j].Name()
+	})
+	return merged, nil
+}
@@ -1 +0,0 @@
-../../../../../lib/web/jquery/dist/jquery.js
\ No newline at end of file
@@ -1 +0,0 @@
-../../../../../lib/web/underscore/underscore.js
\ No newline at end of file
@@ -1 +0,0 @@
-../../../../../lib/web/backbone/backbone.js
\ No newline at end of file
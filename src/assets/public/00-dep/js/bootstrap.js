@@ -1 +0,0 @@
-../../../../../lib/web/bootstrap/dist/js/bootstrap.js
\ No newline at end of file
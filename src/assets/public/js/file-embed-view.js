@@ -4,6 +4,8 @@ var FileEmbedView = Backbone.View.extend({
 	initialize: function(args) {
 		this.files = args.files;
 		this.index = args.index || 0;
+		this.interval = args.interval || 5000;
+		this.playing = false;
 		this.render();
 	},
 
@@ -23,6 +25,62 @@ var FileEmbedView = Backbone.View.extend({
 				self.close();
 			}
 		});
+		this.$('.embed-play').on('click', function() {
+			self.togglePlay();
+		});
+		this.$('.embed-fullscreen').on('click', function() {
+			self.toggleFullscreen();
+		});
+		this.$('.embed-fullscreen').toggle(!!this.el.requestFullscreen);
+
+		// Swiping horizontally moves to the previous or next file.
+		var touchStart = null;
+		this.$('.embed-container').on('touchstart', function(event) {
+			var touch = event.originalEvent.touches[0];
+			touchStart = { x: touch.clientX, y: touch.clientY };
+		});
+		this.$('.embed-container').on('touchend', function(event) {
+			if (!touchStart) {
+				return;
+			}
+			var touch = event.originalEvent.changedTouches[0];
+			var dx = touch.clientX - touchStart.x;
+			var dy = touch.clientY - touchStart.y;
+			touchStart = null;
+			if (Math.abs(dx) > 50 && Math.abs(dx) > 2 * Math.abs(dy)) {
+				self.seek(dx < 0 ? 1 : -1);
+			}
+		});
+
+		this.onKeydown = function(event) {
+			if ($(event.target).is('input, select, textarea')) {
+				return;
+			}
+			switch (event.key) {
+			case 'ArrowLeft':
+				self.seek(-1);
+				break;
+			case 'ArrowRight':
+				self.seek(1);
+				break;
+			case 'Escape':
+				self.close();
+				break;
+			case 'f':
+				self.toggleFullscreen();
+				break;
+			case ' ':
+				// Leave the space bar to media that has focus.
+				if ($(event.target).is('video, audio')) {
+					return;
+				}
+				self.togglePlay();
+				break;
+			default:
+				return;
+			}
+			event.preventDefault();
+		};
 	},
 
 	renderCurrentFile: function() {
@@ -58,12 +116,39 @@ var FileEmbedView = Backbone.View.extend({
 			self.$('.embed-content .embed-close').on('click', function() {
 				self.close();
 			});
+			self.$('.embed-content audio').on('ended', function() {
+				if (self.playing) {
+					self.seek(1);
+				} else {
+					self.nextTrack();
+				}
+			});
 
-			self.$('.do-prev').toggleClass('disabled', self.index === 0);
-			self.$('.do-next').toggleClass('disabled', self.index === self.files.length - 1);
+			self.updateSeek();
+			self.updateLocation();
+			self.preloadNext();
+			if (self.playing) {
+				self.schedule();
+			}
 		}, 200);
 	},
 
+	// Continues with the next audio file once the displayed one has ended.
+	nextTrack: function() {
+		for (var i = this.index + 1; i < this.files.length; i++) {
+			if (this.files[i].type.match(/^audio/)) {
+				this.seek(i - this.index);
+				return;
+			}
+		}
+	},
+
+	// Disables the buttons to seek beyond the first and last file.
+	updateSeek: function() {
+		this.$('.do-prev').toggleClass('disabled', this.index === 0);
+		this.$('.do-next').toggleClass('disabled', this.index === this.files.length - 1);
+	},
+
 	resizeContent: function() {
 		var $content = this.$('.embed-content');
 		$content.css({
@@ -94,15 +179,39 @@ var FileEmbedView = Backbone.View.extend({
 		}, this);
 	},
 
+	// Loads the next image into the browser cache, so it is shown right away
+	// when seeking to it.
+	preloadNext: function() {
+		var next = this.files[this.index + 1];
+		if (next && next.type.match(/^image/)) {
+			new Image().src = URLROOT+'/view/'+next.path;
+		}
+	},
+
+	// Points the fragment of the URL at the displayed file, so the URL can be
+	// shared.
+	updateLocation: function() {
+		var file = this.files[this.index];
+		history.replaceState(null, '', '#file='+encodeURIComponent(file.name));
+	},
+
 	popup: function($expandFrom) {
 		var self = this;
 		$('body > .file-embed').remove();
 		$('body').prepend(this.$el);
+		$(document).on('keydown', this.onKeydown);
 		this.renderCurrentFile();
 	},
 
 	close: function() {
+		this.stop();
+		if (document.fullscreenElement === this.el) {
+			document.exitFullscreen();
+		}
+		$(document).off('keydown', this.onKeydown);
+		history.replaceState(null, '', location.pathname+location.search);
 		this.$el.remove();
+		this.trigger('close');
 	},
 
 	seek: function(delta) {
@@ -119,76 +228,165 @@ var FileEmbedView = Backbone.View.extend({
 		}
 	},
 
-	template: _.template(
-		'<div class="file-embed">'+
+	togglePlay: function() {
+		if (this.playing) {
+			this.stop();
+		} else {
+			this.play();
+		}
+	},
+
+	// Starts the slideshow, which moves to the next file at the interval and
+	// stops at the last file.
+	play: function() {
+		this.playing = true;
+		this.$('.embed-play').removeClass('fa-play').addClass('fa-pause').attr('title', 'Pause slideshow');
+		this.schedule();
+	},
+
+	stop: function() {
+		this.playing = false;
+		clearTimeout(this.timer);
+		this.$('.embed-play').removeClass('fa-pause').addClass('fa-play').attr('title', 'Play slideshow');
+	},
+
+	schedule: function() {
+		var self = this;
+		clearTimeout(this.timer);
+		// Audio is played to the end instead.
+		if (this.files[this.index].type.match(/^audio/)) {
+			return;
+		}
+		this.timer = setTimeout(function() {
+			if (self.index >= self.files.length - 1) {
+				self.stop();
+				return;
+			}
+			self.seek(1);
+		}, this.interval);
+	},
+
+	toggleFullscreen: function() {
+		if (document.fullscreenElement) {
+			document.exitFullscreen();
+		} else if (this.el.requestFullscreen) {
+			this.el.requestFullscreen();
+		}
+	},
+
+	template: function() {
+		return '<div class="file-embed">'+
 			'<div class="embed-bg"></div>'+
 
 			'<a class="embed-seek do-prev fa fa-chevron-left"></a>'+
 			'<div class="embed-container"></div>'+
 			'<a class="embed-seek do-next fa fa-chevron-right"></a>'+
-		'</div>'
-	),
-	contentTemplate: _.template(
-		'<div class="embed-content fade-out file-type-<%- file.type.replace(/\\W/g, \'-\') %>">'+
-			'<%= fileView %>'+
+
+			'<div class="embed-controls">'+
+				'<a class="embed-control embed-play fa fa-play" title="Play slideshow"></a>'+
+				'<a class="embed-control embed-fullscreen fa fa-expand" title="Fullscreen"></a>'+
+			'</div>'+
+		'</div>';
+	},
+	contentTemplate: function(args) {
+		return '<div class="embed-content fade-out file-type-'+_.escape(args.file.type.replace(/\W/g, '-'))+'">'+
+			args.fileView+
 			'<a class="embed-actionbutton embed-close fa fa-close" title="Close"></a>'+
 			'<a class="embed-actionbutton embed-download fa fa-external-link"'+
-				'href="<%= urlroot %>/get/<%- file.path %>"'+
+				'href="'+args.urlroot+'/get/'+_.escape(args.file.path)+'"'+
 				'target="_blank"'+
 				'title="Open / Download / Expand"></a>'+
-			'<p class="embed-title"><%- file.name %></p>'+
-		'</div>'
-	),
+			'<p class="embed-title">'+_.escape(args.file.name)+'</p>'+
+		'</div>';
+	},
 });
 
+// The templates are plain functions rather than compiled by _.template, which
+// would require the Content-Security-Policy to allow eval.
 var fileViewTemplates = [
 	{
 		match:    [ /^video/ ],
 		loading:  true,
-		template: _.template(
-			'<video class="embed-media" controls autoplay loop>'+
-				'<source type="video/mp4" src="<%= urlroot %>/view/<%- file.path %>?fmt=video%2Fmp4" />'+
-				'<source type="video/webm" src="<%= urlroot %>/view/<%- file.path %>?fmt=video%2Fwebm" />'+
-			'</video>'
-		),
+		template: function(args) {
+			var src = args.urlroot+'/view/'+_.escape(args.file.path);
+			return '<video class="embed-media" controls autoplay loop>'+
+				'<source type="video/mp4" src="'+src+'?fmt=video%2Fmp4" />'+
+				'<source type="video/webm" src="'+src+'?fmt=video%2Fwebm" />'+
+			'</video>';
+		},
+	},
+	{
+		match:    [ /^audio/ ],
+		loading:  false,
+		template: function(args) {
+			var file = args.file;
+			var tags = file.tags || {};
+			var cover = file.hasThumb
+				? '<img class="audio-cover" src="'+args.urlroot+'/thumb/'+_.escape(file.path)+'.jpg" alt="" />'
+				: '<span class="audio-cover fa fa-music"></span>';
+			var track = tags.track ? '<span class="audio-track">'+_.escape(tags.track)+'.</span> ' : '';
+			return '<div class="embed-media embed-audio">'+
+				cover+
+				'<p class="audio-title">'+track+_.escape(tags.title || file.name)+'</p>'+
+				'<p class="audio-artist">'+_.escape([tags.artist, tags.album, tags.year].filter(Boolean).join(' · '))+'</p>'+
+				'<audio controls autoplay src="'+args.urlroot+'/view/'+_.escape(file.path)+'"></audio>'+
+			'</div>';
+		},
 	},
 	{
 		match:    [ /^image/ ],
 		loading:  true,
-		template: _.template(
-			'<img class="embed-media" src="<%= urlroot %>/view/<%- file.path %>" />'
-		),
+		template: function(args) {
+			return '<img class="embed-media" src="'+args.urlroot+'/view/'+_.escape(args.file.path)+'" />';
+		},
+	},
+	{
+		// Markdown is rendered by the server.
+		match:    [ /^text\/markdown/ ],
+		loading:  true,
+		template: function(args) {
+			return '<iframe class="embed-media" style="width:800px;height:600px" src="'+args.urlroot+'/view/'+_.escape(args.file.path)+'?fmt=text%2Fhtml" />';
+		},
+	},
+	{
+		// Text is highlighted by the server.
+		match:    [ /^text\/.*$/, /^application\/(javascript|json|toml|x-sh|x-yaml|xml|yaml)\b/, /\+(json|xml)\b/ ],
+		loading:  true,
+		template: function(args) {
+			return '<iframe class="embed-media" style="width:800px;height:600px" src="'+args.urlroot+'/preview/'+_.escape(args.file.path)+'?embed=1" />';
+		},
 	},
 	{
-		match:    [ /^text\/.*$/, /^application\/pdf$/ ],
+		match:    [ /^application\/pdf$/ ],
 		loading:  true,
-		template: _.template(
-			'<iframe class="embed-media" style="width:800px;height:600px" src="<%= urlroot %>/view/<%- file.path %>" />'
-		),
+		template: function(args) {
+			return '<iframe class="embed-media" style="width:800px;height:600px" src="'+args.urlroot+'/view/'+_.escape(args.file.path)+'" />';
+		},
 	},
 	{
 		match:    [ /^directory$/ ],
 		loading:  false,
-		template: _.template(
-			'<a '+
+		template: function(args) {
+			var path = _.escape(args.file.path);
+			return '<a '+
 				'class="embed-media embed-directory" '+
-				'href="<%= urlroot %>/view/<%- file.path %>" '+
-				'style="width:140px;height:140px;background-image:url(\'<%= urlroot %>/thumb/<%- file.path.replace(/\'/g, \'\\\\\\\'\') %>.jpg\')" '+
+				'href="'+args.urlroot+'/view/'+path+'" '+
+				'style="width:140px;height:140px;background-image:url(\''+args.urlroot+'/thumb/'+_.escape(args.file.path.replace(/'/g, '\\\''))+'.jpg\')" '+
 				'target="_blank" '+
-				'></a>'
-		),
+				'></a>';
+		},
 	},
 	{
 		match:    [ /^.*$/ ],
 		loading:  false,
-		template: _.template(
-			'<a '+
+		template: function(args) {
+			return '<a '+
 				'class="embed-media embed-unknown" '+
-				'href="<%= urlroot %>/view/<%- file.path %>" '+
+				'href="'+args.urlroot+'/view/'+_.escape(args.file.path)+'" '+
 				'target="_blank" '+
 				'title="Download this file"'+
 				'><span class="fa fa-arrow-circle-down"></span>'+
-			'</a>'
-		),
+			'</a>';
+		},
 	},
 ];
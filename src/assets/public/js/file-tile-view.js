@@ -4,76 +4,108 @@ var FileTileView = Backbone.View.extend({
 	initialize: function(args) {
 		var self = this;
 
-		this.files = args.files;
-		this.setElement(this.template({
-			files:     this.files,
-			urlroot:   URLROOT,
-			iconClass: function(file) {
-				return self.icons.find(function(icon) {
-					if (typeof icon.match === 'function') {
-						return icon.match(file);
-					}
-					return icon.match.some(function(expression) {
-						return file.type.match(expression);
-					});
-				}).class;
-			},
-		}));
+		// The files of the pages loaded so far, the first of which is at
+		// the offset in the whole listing.
+		this.offset = args.offset;
+		this.files = this.parseFiles(this.$el);
 
-		this.$('li').on('click', function(event) {
-			event.preventDefault();
+		this.$el.on('click', '[data-index]', function(event) {
 			var $self = $(this);
-			var index = parseInt($self.attr('data-index'), 10);
-			self.trigger('select', self.files[index], index, self.files, $self);
+			var index = parseInt($self.attr('data-index'), 10) - self.offset;
+			var file = self.files[index];
+			// Directories and links opened in a new tab are left to the
+			// browser.
+			if (file.type === 'directory' || event.ctrlKey || event.metaKey || event.shiftKey) {
+				return;
+			}
+			event.preventDefault();
+			self.trigger('select', file, index, self.files, $self);
 		});
+
+		this.observeNext();
+	},
+
+	parseFiles: function($el) {
+		return JSON.parse($el.find('.fs-listing-files').text());
+	},
+
+	// Loads the next page of the listing once the link to it is scrolled
+	// into view.
+	observeNext: function() {
+		var self = this;
+		var $next = this.$('.fs-listing-next');
+		if (this.observer) {
+			this.observer.disconnect();
+		}
+		if (!$next.length || !window.IntersectionObserver) {
+			return;
+		}
+		this.observer = new IntersectionObserver(function(entries) {
+			if (!entries[0].isIntersecting) {
+				return;
+			}
+			self.observer.disconnect();
+			self.loadNext($next);
+		}, {rootMargin: '400px'});
+		this.observer.observe($next[0]);
+	},
+
+	// Loads the next page of the listing, if any. The returned promise is
+	// resolved with whether a page was loaded.
+	loadMore: function() {
+		var $next = this.$('.fs-listing-next');
+		if (!$next.length) {
+			return $.Deferred().resolve(false).promise();
+		}
+		return this.loadNext($next);
 	},
 
-	icons: [
-		{
-			match: function(file) {
-				return file.type.match(/^directory$/) && !file.isUnlocked;
-			},
-			class: 'fa-lock tile-icon-show',
-		},
-		{
-			match: [ /^directory$/ ],
-			class: 'fa-folder',
-		},
-		{
-			match: [ /^video/, /^image\/gif$/ ],
-			class: 'fa-play tile-icon-show',
-		},
-		{
-			match: [ /^image/ ],
-			class: '', // Don't show an icon for images.
-		},
-		{
-			match: [ /^text/, /^application\/pdf$/ ],
-			class: 'fa-file-text',
-		},
-		{
-			match: [ /^.*$/ ],
-			class: 'fa-file',
-		},
-	],
+	loadNext: function($next) {
+		var self = this;
+		if (this.loading) {
+			return this.loading;
+		}
+		$next.addClass('disabled');
+		var loaded = $.Deferred();
+		this.loading = loaded.promise();
+		$.get($next.attr('href')).done(function(html) {
+			var $page = $(new DOMParser().parseFromString(html, 'text/html')).find('.fs-listing');
+			// The array is extended rather than replaced, so views that
+			// were handed the files see the new ones.
+			Array.prototype.push.apply(self.files, self.parseFiles($page));
+			self.$('.file-tilelist, .file-list tbody').append($page.find('[data-index]'));
+
+			var href = $page.find('.fs-listing-next').attr('href');
+			if (href) {
+				$next.attr('href', href).removeClass('disabled');
+				self.observeNext();
+			} else {
+				$next.remove();
+			}
+			self.loading = null;
+			loaded.resolve(true);
+		}).fail(function() {
+			// Fall back to navigating to the next page.
+			$next.removeClass('disabled');
+			self.loading = null;
+			loaded.resolve(false);
+		});
+		return this.loading;
+	},
 
-	template: _.template(
-		'<ul class="file-tilelist">'+
-			'<% files.forEach(function(file, index) { %>'+
-				'<li '+
-					'class="file-tile file-type-<%- file.type.replace(/\\W/g, \'-\') %> <%= file.hasThumb ? \'fs-thumb\' : \'\' %>" '+
-					'data-index="<%= index %>">'+
-					'<div class="tile-icon fa fa-fw fa-5x <%= iconClass(file) %>"></div>'+
-					'<div '+
-						'class="tile-background"'+
-						'title="<%- name %>"'+
-						'style="<% if (file.hasThumb) { %>'+
-							'background-image: url(\'<%= urlroot %>/thumb/<%- file.path.replace(/\'/g, \'\\\\\\\'\') %>.jpg\')'+
-						'<% } %>">'+
-							'<p class="file-title"><%- file.name %></p>'+
-						'</div>'+
-				'</li>'+
-			'<% }) %>'+
-		'</ul>'
-	),
+	// Finds the index of the file with the name, loading more pages until it
+	// is found. The returned promise is resolved with -1 if there is no such
+	// file.
+	findFile: function(name) {
+		var self = this;
+		var index = this.files.findIndex(function(file) {
+			return file.name === name;
+		});
+		if (index !== -1) {
+			return $.Deferred().resolve(index).promise();
+		}
+		return this.loadMore().then(function(loaded) {
+			return loaded ? self.findFile(name) : -1;
+		});
+	},
 });
@@ -1,41 +1,86 @@
 'use strict';
 
 function initApp(options) {
-	var pathbar = new PathBar({
-		path: options.path,
+	// The listing options are applied as soon as one is changed.
+	var $options = $('.fs-listing-options');
+	$options.find('.fs-listing-apply').hide();
+	$options.find('select').on('change', function() {
+		$options.submit();
 	});
-	pathbar.on('navigate', function(path) {
-		window.location = URLROOT+'/view/'+path;
-	});
-	$('.fs-header').append(pathbar.$el);
 
-	var files = options.files.sort(function(a, b) {
-		function dirs(a, b) {
-			return a.type === 'directory' && b.type !== 'directory' ? -1
-				: b.type === 'directory' && a.type !== 'directory' ? 1
-				: 0;
-		}
-		function paths(a, b) {
-			return a.path > b.path ? 1
-				: a.path < b.path ? -1
-				: 0;
-		}
-		return dirs(a, b) || paths(a, b);
-	});
+	// The listing is rendered by the server, the tile view only enhances it
+	// by showing files in a popup instead of navigating to them.
 	var tileView = new FileTileView({
-		files: files,
+		el:     $('.fs-listing'),
+		offset: options.offset,
 	});
-	$('.fs-tilelist-container').append(tileView.$el);
 
-	tileView.on('select', function(file, index, files, $el) {
-		if (file.type === 'directory') {
-			window.location = URLROOT+'/view/'+file.path;
-			return;
-		}
+	var openEmbed = function(index, $el) {
 		var embed = new FileEmbedView({
-			files: files,
-			index: index,
+			files:    tileView.files,
+			index:    index,
+			interval: options.slideshowInterval,
+		});
+		// Load more files before the slideshow reaches the end of those
+		// that are loaded.
+		embed.on('seek', function(index) {
+			if (index >= tileView.files.length - 5) {
+				tileView.loadMore().done(function(loaded) {
+					if (loaded) {
+						embed.updateSeek();
+					}
+				});
+			}
 		});
 		embed.popup($el);
+	};
+
+	tileView.on('select', function(file, index, files, $el) {
+		openEmbed(index, $el);
+	});
+
+	// Links to a file in a directory look like /view/dir#file=name.
+	var match = location.hash.match(/^#file=(.*)$/);
+	if (match) {
+		tileView.findFile(decodeURIComponent(match[1])).done(function(index) {
+			var file = tileView.files[index];
+			if (file && file.type !== 'directory') {
+				openEmbed(index, tileView.$('[data-index="'+(tileView.offset + index)+'"]'));
+			}
+		});
+	}
+}
+
+function initMap(options) {
+	var files = JSON.parse($('.fs-map-files').text());
+	var mapView = new MapView({
+		el:          $('.fs-map'),
+		files:       files,
+		tileURL:     options.tileURL,
+		attribution: options.attribution,
+		maxZoom:     options.maxZoom,
+	});
+
+	var openEmbed = function(index, $el) {
+		new FileEmbedView({
+			files:    files,
+			index:    index,
+			interval: options.slideshowInterval,
+		}).popup($el);
+	};
+
+	mapView.on('select', function(file, index, files, $el) {
+		openEmbed(index, $el);
 	});
+
+	var match = location.hash.match(/^#file=(.*)$/);
+	if (match) {
+		var name = decodeURIComponent(match[1]);
+		var index = files.findIndex(function(file) {
+			return file.name === name;
+		});
+		if (index >= 0) {
+			openEmbed(index, mapView.$el);
+		}
+	}
 }
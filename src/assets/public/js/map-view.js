@@ -0,0 +1,267 @@
+'use strict';
+
+// MapView plots the geotagged files on a slippy map in the Web Mercator
+// projection. The tiles are loaded from the configured tile server; without
+// one, the markers are shown on a blank background.
+var MapView = Backbone.View.extend({
+	TILE_SIZE: 256,
+	// Markers closer to each other than this many pixels are clustered.
+	CLUSTER_SIZE: 60,
+
+	initialize: function(args) {
+		var self = this;
+
+		this.files = args.files;
+		this.tileURL = args.tileURL;
+		this.maxZoom = args.maxZoom || 18;
+
+		this.$el.html(this.template({attribution: args.attribution}));
+		this.$tiles = this.$('.map-tiles');
+		this.$markers = this.$('.map-markers');
+
+		this.$('.map-zoom-in').on('click', function() {
+			self.zoomAround(self.zoom + 1, self.width() / 2, self.height() / 2);
+		});
+		this.$('.map-zoom-out').on('click', function() {
+			self.zoomAround(self.zoom - 1, self.width() / 2, self.height() / 2);
+		});
+		this.$markers.on('click', '.map-marker', function(event) {
+			event.stopPropagation();
+			self.selectCluster(self.clusters[parseInt($(this).attr('data-cluster'), 10)]);
+		});
+		this.$el.on('click', '.map-popup [data-index]', function(event) {
+			event.preventDefault();
+			var index = parseInt($(this).attr('data-index'), 10);
+			self.trigger('select', self.files[index], index, self.files, $(this));
+		});
+		this.$('.map-canvas').on('click', function(event) {
+			if (!$(event.target).closest('.map-popup').length) {
+				self.$('.map-popup').remove();
+			}
+		});
+		this.bindPanning();
+		this.$('.map-canvas').on('wheel', function(event) {
+			event.preventDefault();
+			var offset = self.$el.offset();
+			var delta = event.originalEvent.deltaY < 0 ? 1 : -1;
+			self.zoomAround(self.zoom + delta, event.originalEvent.pageX - offset.left, event.originalEvent.pageY - offset.top);
+		});
+		$(window).on('resize', function() {
+			self.render();
+		});
+
+		this.fitFiles();
+		this.render();
+	},
+
+	width: function() {
+		return this.$('.map-canvas').width();
+	},
+
+	height: function() {
+		return this.$('.map-canvas').height();
+	},
+
+	// Projects a location to pixels on the whole map at the zoom level.
+	project: function(lat, long, zoom) {
+		var scale = this.TILE_SIZE * Math.pow(2, zoom);
+		var sin = Math.sin(lat * Math.PI / 180);
+		return {
+			x: (long + 180) / 360 * scale,
+			y: (0.5 - Math.log((1 + sin) / (1 - sin)) / (4 * Math.PI)) * scale,
+		};
+	},
+
+	// Centers the map on the files at the highest zoom level at which they
+	// are all visible.
+	fitFiles: function() {
+		var self = this;
+		if (!this.files.length) {
+			this.zoom = 1;
+			this.center = {x: this.TILE_SIZE, y: this.TILE_SIZE};
+			return;
+		}
+		var points = this.files.map(function(file) {
+			return self.project(file.lat, file.long, 0);
+		});
+		var min = {x: Infinity, y: Infinity}, max = {x: -Infinity, y: -Infinity};
+		points.forEach(function(p) {
+			min.x = Math.min(min.x, p.x); min.y = Math.min(min.y, p.y);
+			max.x = Math.max(max.x, p.x); max.y = Math.max(max.y, p.y);
+		});
+		var padding = 2 * this.CLUSTER_SIZE;
+		// Files close to each other are not shown closer than street level.
+		var maxZoom = Math.min(this.maxZoom, 16);
+		this.zoom = 0;
+		while (this.zoom < maxZoom) {
+			var scale = Math.pow(2, this.zoom + 1);
+			if ((max.x - min.x) * scale > this.width() - padding || (max.y - min.y) * scale > this.height() - padding) {
+				break;
+			}
+			this.zoom++;
+		}
+		var s = Math.pow(2, this.zoom);
+		this.center = {x: (min.x + max.x) / 2 * s, y: (min.y + max.y) / 2 * s};
+	},
+
+	// Changes the zoom level while keeping the point at x, y relative to the
+	// map in place.
+	zoomAround: function(zoom, x, y) {
+		zoom = Math.max(0, Math.min(this.maxZoom, zoom));
+		if (zoom === this.zoom) {
+			return;
+		}
+		var scale = Math.pow(2, zoom - this.zoom);
+		var dx = x - this.width() / 2, dy = y - this.height() / 2;
+		this.center = {
+			x: (this.center.x + dx) * scale - dx,
+			y: (this.center.y + dy) * scale - dy,
+		};
+		this.zoom = zoom;
+		this.render();
+	},
+
+	// Dragging the map with the mouse or a finger moves it.
+	bindPanning: function() {
+		var self = this;
+		var $canvas = this.$('.map-canvas');
+		var last = null;
+		$canvas.on('pointerdown', function(event) {
+			if ($(event.target).closest('.map-marker, .map-popup, .map-controls').length) {
+				return;
+			}
+			last = {x: event.originalEvent.clientX, y: event.originalEvent.clientY};
+			this.setPointerCapture(event.originalEvent.pointerId);
+			$canvas.addClass('dragging');
+		});
+		$canvas.on('pointermove', function(event) {
+			if (!last) {
+				return;
+			}
+			var e = event.originalEvent;
+			self.center.x -= e.clientX - last.x;
+			self.center.y -= e.clientY - last.y;
+			last = {x: e.clientX, y: e.clientY};
+			self.render();
+		});
+		$canvas.on('pointerup pointercancel', function() {
+			last = null;
+			$canvas.removeClass('dragging');
+		});
+	},
+
+	render: function() {
+		this.$('.map-popup').remove();
+		this.renderTiles();
+		this.renderMarkers();
+		this.$('.map-zoom-in').prop('disabled', this.zoom >= this.maxZoom);
+		this.$('.map-zoom-out').prop('disabled', this.zoom <= 0);
+	},
+
+	renderTiles: function() {
+		if (!this.tileURL) {
+			return;
+		}
+		var size = this.TILE_SIZE;
+		var count = Math.pow(2, this.zoom);
+		var left = this.center.x - this.width() / 2, top = this.center.y - this.height() / 2;
+		var tiles = document.createDocumentFragment();
+		for (var ty = Math.floor(top / size); ty * size < top + this.height(); ty++) {
+			if (ty < 0 || ty >= count) {
+				continue;
+			}
+			for (var tx = Math.floor(left / size); tx * size < left + this.width(); tx++) {
+				// The map repeats horizontally.
+				var x = ((tx % count) + count) % count;
+				var img = document.createElement('img');
+				img.className = 'map-tile';
+				img.alt = '';
+				img.src = this.tileURL.replace('{z}', this.zoom).replace('{x}', x).replace('{y}', ty);
+				img.style.left = Math.round(tx * size - left)+'px';
+				img.style.top = Math.round(ty * size - top)+'px';
+				tiles.appendChild(img);
+			}
+		}
+		this.$tiles.empty().append(tiles);
+	},
+
+	// Groups the files whose markers are in the same cell of a grid over the
+	// map and shows a marker for each group.
+	renderMarkers: function() {
+		var self = this;
+		var left = this.center.x - this.width() / 2, top = this.center.y - this.height() / 2;
+		var cells = {};
+		this.clusters = [];
+		this.files.forEach(function(file, index) {
+			var p = self.project(file.lat, file.long, self.zoom);
+			var key = Math.floor(p.x / self.CLUSTER_SIZE)+','+Math.floor(p.y / self.CLUSTER_SIZE);
+			var cluster = cells[key];
+			if (!cluster) {
+				cluster = cells[key] = {x: 0, y: 0, indices: []};
+				self.clusters.push(cluster);
+			}
+			cluster.x += p.x;
+			cluster.y += p.y;
+			cluster.indices.push(index);
+		});
+		this.$markers.html(this.clusters.map(function(cluster, i) {
+			cluster.left = Math.round(cluster.x / cluster.indices.length - left);
+			cluster.top = Math.round(cluster.y / cluster.indices.length - top);
+			return self.markerTemplate({
+				index: i,
+				count: cluster.indices.length,
+				left:  cluster.left,
+				top:   cluster.top,
+			});
+		}).join(''));
+	},
+
+	// Zooms in on a cluster until its files are apart, or shows the files in
+	// a popup if they can not be told apart at the highest zoom level.
+	selectCluster: function(cluster) {
+		if (cluster.indices.length > 1 && this.zoom < this.maxZoom) {
+			this.zoomAround(this.zoom + 2, cluster.left, cluster.top);
+			return;
+		}
+		var self = this;
+		this.$('.map-popup').remove();
+		var $popup = $(this.popupTemplate({
+			urlroot: URLROOT,
+			files:   cluster.indices.map(function(index) {
+				return {index: index, file: self.files[index]};
+			}),
+		}));
+		$popup.css({left: cluster.left, top: cluster.top});
+		this.$markers.append($popup);
+	},
+
+	template: function(args) {
+		return '<div class="map-canvas">'+
+			'<div class="map-tiles"></div>'+
+			'<div class="map-markers"></div>'+
+			'<div class="map-controls btn-group-vertical">'+
+				'<button class="btn btn-default map-zoom-in" title="Zoom in"><span class="fa fa-plus"></span></button>'+
+				'<button class="btn btn-default map-zoom-out" title="Zoom out"><span class="fa fa-minus"></span></button>'+
+			'</div>'+
+			(args.attribution ? '<div class="map-attribution">'+_.escape(args.attribution)+'</div>' : '')+
+		'</div>';
+	},
+
+	markerTemplate: function(args) {
+		return '<div class="map-marker'+(args.count > 1 ? ' map-cluster' : '')+'" data-cluster="'+_.escape(args.index)+'" style="left:'+_.escape(args.left)+'px;top:'+_.escape(args.top)+'px">'+
+			(args.count > 1 ? _.escape(args.count) : '<span class="fa fa-camera"></span>')+
+		'</div>';
+	},
+
+	popupTemplate: function(args) {
+		return '<div class="map-popup">'+
+			args.files.map(function(f) {
+				var path = _.escape(f.file.path);
+				return '<a class="map-popup-file" href="'+args.urlroot+'/get/'+path+'" data-index="'+_.escape(f.index)+'" title="'+_.escape(f.file.name)+'">'+
+					(f.file.hasThumb ? '<img src="'+args.urlroot+'/thumb/'+path+'.jpg" alt="" />' : '')+
+					'<span class="map-popup-title">'+_.escape(f.file.name)+'</span>'+
+				'</a>';
+			}).join('')+
+		'</div>';
+	},
+});
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+type AuditAction string
+
+const (
+	ActionView     AuditAction = "view"
+	ActionGet      AuditAction = "get"
+	ActionZip      AuditAction = "zip"
+	ActionThumb    AuditAction = "thumb"
+	ActionUnlock   AuditAction = "unlock"
+	ActionTimeline AuditAction = "timeline"
+	ActionMap      AuditAction = "map"
+	ActionPreview  AuditAction = "preview"
+	ActionPlaylist AuditAction = "playlist"
+)
+
+const (
+	ResultOK         = "ok"
+	ResultAuthFailed = "auth-failed"
+	ResultDenied     = "denied"
+	ResultNotFound   = "not-found"
+	ResultError      = "error"
+)
+
+// An AuditEntry records a single access to the filesystem. Entries are created
+// by the audit middleware and completed by handlers and authenticators while
+// the request is served.
+type AuditEntry struct {
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id,omitempty"`
+	Identity  string      `json:"identity,omitempty"`
+	Token     string      `json:"token,omitempty"`
+	ClientIP  string      `json:"client_ip"`
+	Path      string      `json:"path"`
+	Action    AuditAction `json:"action"`
+	Bytes     int         `json:"bytes"`
+	Status    int         `json:"status"`
+	Result    string      `json:"result"`
+}
+
+func auditEntry(r *http.Request) *AuditEntry {
+	entry, _ := r.Context().Value(auditContextKey).(*AuditEntry)
+	return entry
+}
+
+// auditIdentity records the user on whose behalf a request is made.
+func auditIdentity(r *http.Request, user string) {
+	if entry := auditEntry(r); entry != nil && user != "" {
+		entry.Identity = user
+	}
+}
+
+// auditToken records the API token used to make a request.
+func auditToken(r *http.Request, tok *Token) {
+	if entry := auditEntry(r); entry != nil {
+		entry.Token = tok.ID
+		entry.Identity = tok.Name
+	}
+}
+
+// auditAuthFailed marks the request as a failed attempt to unlock a file.
+func auditAuthFailed(r *http.Request, user string) {
+	if entry := auditEntry(r); entry != nil {
+		entry.Identity = user
+		entry.Result = ResultAuthFailed
+	}
+}
+
+// AuditLog writes AuditEntries as JSON lines to one or more sinks.
+type AuditLog struct {
+	sinks          []io.Writer
+	trustedProxies TrustedProxies
+	lock           sync.Mutex
+}
+
+func NewAuditLog(trustedProxies TrustedProxies, sinks ...io.Writer) *AuditLog {
+	return &AuditLog{
+		sinks:          sinks,
+		trustedProxies: trustedProxies,
+	}
+}
+
+// NewSyslogSink connects to the local syslog daemon.
+func NewSyslogSink() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "webfs")
+}
+
+func (al *AuditLog) Log(entry *AuditEntry) {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		panic(err)
+	}
+	buf = append(buf, '\n')
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	for _, sink := range al.sinks {
+		if _, err := sink.Write(buf); err != nil {
+			auditLogger.Error("Could not write audit log", "err", err)
+		}
+	}
+}
+
+// Close closes all sinks that need to be closed.
+func (al *AuditLog) Close() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	var firstErr error
+	for _, sink := range al.sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Middleware records every request handled by the wrapped handler as the
+// specified action. It must be used after fsPathCtx. A nil AuditLog records
+// nothing.
+func (al *AuditLog) Middleware(action AuditAction) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if al == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := &AuditEntry{
+				Time:      time.Now(),
+				RequestID: middleware.GetReqID(r.Context()),
+				Path:      r.Context().Value(pathContextKey).(string),
+				Action:    action,
+			}
+			if ip := al.trustedProxies.ClientIP(r); ip != nil {
+				entry.ClientIP = ip.String()
+			}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ctx := context.WithValue(r.Context(), auditContextKey, entry)
+
+			defer func() {
+				entry.Status = ww.Status()
+				entry.Bytes = ww.BytesWritten()
+				if entry.Result == "" && entry.Status == 0 {
+					// The handler failed without writing a response.
+					entry.Result = ResultError
+				}
+				if entry.Status == 0 {
+					entry.Status = http.StatusOK
+				}
+				if entry.Result == "" {
+					entry.Result = auditResult(entry.Status)
+				}
+				al.Log(entry)
+			}()
+			next.ServeHTTP(ww, r.WithContext(ctx))
+		})
+	}
+}
+
+func auditResult(status int) string {
+	switch {
+	case status < 400:
+		return ResultOK
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return ResultDenied
+	case status == http.StatusNotFound:
+		return ResultNotFound
+	default:
+		return ResultError
+	}
+}
+
+// RotatingFile is an append-only file that is rotated once it exceeds a
+// maximum size. Rotated files get a numeric suffix, the oldest are removed.
+type RotatingFile struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	fd   *os.File
+	size int64
+}
+
+func NewRotatingFile(filename string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	fd, err := os.OpenFile(rf.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	rf.fd = fd
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.fd.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", rf.filename, rf.maxBackups))
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.filename, i), fmt.Sprintf("%s.%d", rf.filename, i+1))
+	}
+	if rf.maxBackups > 0 {
+		if err := os.Rename(rf.filename, rf.filename+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.filename); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.fd.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.fd.Close()
+}
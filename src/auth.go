@@ -15,6 +15,7 @@ import (
 	"github.com/gorilla/sessions"
 
 	"webfs/src/fs"
+	"webfs/src/metrics"
 )
 
 var rePasswd = regexp.MustCompile("(?m)^([^\\s]+)\\s([^\\s]+)$")
@@ -23,19 +24,26 @@ var rePasswd = regexp.MustCompile("(?m)^([^\\s]+)\\s([^\\s]+)$")
 // the specified file until the root of the virtual filesystem is reached. If
 // no password file exists, nil is returned.
 func findAuthFile(filesystem *fs.Filesystem, filename string) (string, error) {
+	return findSpecialFile(filesystem, filename, ".passwd.txt")
+}
+
+// Finds the nearest file with the specified name in the directory of the
+// specified file or one of its parents within the virtual filesystem. If no
+// such file exists, "" is returned.
+func findSpecialFile(filesystem *fs.Filesystem, filename, name string) (string, error) {
 	dir := filename
 	if info, err := os.Stat(dir); err != nil {
-		return "", fmt.Errorf("could not find auth file: %v", err)
+		return "", fmt.Errorf("could not find %s: %v", name, err)
 	} else if !info.IsDir() {
 		dir = filepath.Dir(filename)
 	}
 
 	for strings.HasPrefix(dir, filesystem.Mount()) {
-		f := filepath.Join(dir, ".passwd.txt")
+		f := filepath.Join(dir, name)
 		if _, err := os.Stat(f); err == nil {
 			return f, nil
 		} else if !os.IsNotExist(err) {
-			return "", fmt.Errorf("could not find auth file: %v", err)
+			return "", fmt.Errorf("could not find %s: %v", name, err)
 		}
 		dir = filepath.Dir(dir)
 	}
@@ -69,8 +77,16 @@ type Authenticator interface {
 	// contains a list of possible username/password pairs separated by newlines.
 	// The username and password are separated by whitespace. Neither the username
 	// or password may therefore contain whitespace.
+	//
+	// If the directory also requires a second factor, a *SecondFactorRequired
+	// error is returned after the credentials have been accepted.
 	Authenticate(filename string, w http.ResponseWriter, r *http.Request) (bool, error)
 
+	// Checks the TOTP code or recovery code entered by a user who has passed
+	// the first factor for the specified file. Returns true if the file has
+	// been unlocked.
+	VerifySecondFactor(filename, code string, w http.ResponseWriter, r *http.Request) (bool, error)
+
 	HasPassword(filename string) (bool, error)
 
 	FSAuthenticator(req *http.Request) fs.Authenticator
@@ -85,6 +101,10 @@ func (NilAuthenticator) Authenticate(string, http.ResponseWriter, *http.Request)
 	return true, nil
 }
 
+func (NilAuthenticator) VerifySecondFactor(string, string, http.ResponseWriter, *http.Request) (bool, error) {
+	return true, nil
+}
+
 func (a NilAuthenticator) HasPassword(filename string) (bool, error) {
 	authFile, err := findAuthFile(a.Filesystem, filename)
 	return authFile != "", err
@@ -95,11 +115,12 @@ func (NilAuthenticator) FSAuthenticator(req *http.Request) fs.Authenticator {
 }
 
 type BasicAuthenticator struct {
-	filesystem *fs.Filesystem
-	store      sessions.Store
+	filesystem     *fs.Filesystem
+	store          sessions.Store
+	trustedProxies TrustedProxies
 }
 
-func NewBasicAuthenticator(filesystem *fs.Filesystem, storageDir string) (*BasicAuthenticator, error) {
+func NewBasicAuthenticator(filesystem *fs.Filesystem, storageDir string, trustedProxies TrustedProxies) (*BasicAuthenticator, error) {
 	if err := os.MkdirAll(storageDir, 0700); err != nil {
 		return nil, err
 	}
@@ -121,12 +142,51 @@ func NewBasicAuthenticator(filesystem *fs.Filesystem, storageDir string) (*Basic
 	}
 
 	return &BasicAuthenticator{
-		filesystem: filesystem,
-		store:      sessions.NewFilesystemStore(storageDir, secret),
+		filesystem:     filesystem,
+		store:          sessions.NewFilesystemStore(storageDir, secret),
+		trustedProxies: trustedProxies,
 	}, nil
 }
 
+// checkAccess evaluates the .access.txt that applies to the specified file
+// against the address of the client.
+func (auth *BasicAuthenticator) checkAccess(filename string, r *http.Request) (accessDecision, error) {
+	accessFile, err := findSpecialFile(auth.filesystem, filename, accessFileName)
+	if err != nil {
+		return accessDenied, err
+	}
+	if accessFile == "" {
+		return accessNeedPassword, nil
+	}
+	rules, err := readAccessFile(accessFile)
+	if err != nil {
+		// Deny access if the access file can not be read.
+		return accessDenied, err
+	}
+	passwdFile, err := findAuthFile(auth.filesystem, filename)
+	if err != nil {
+		return accessDenied, err
+	}
+	decision := rules.Decide(auth.trustedProxies.ClientIP(r), passwdFile != "")
+	// The rules only stand in for the passwords of their own directory and
+	// above, a password file further down still has to be entered.
+	if decision == accessGranted && passwdFile != "" && len(filepath.Dir(passwdFile)) > len(filepath.Dir(accessFile)) {
+		decision = accessNeedPassword
+	}
+	return decision, nil
+}
+
 func (auth *BasicAuthenticator) Authenticate(filename string, w http.ResponseWriter, r *http.Request) (bool, error) {
+	switch access, err := auth.checkAccess(filename, r); {
+	case err != nil:
+		return false, err
+	case access == accessDenied:
+		w.WriteHeader(http.StatusForbidden)
+		return false, nil
+	case access == accessGranted:
+		return true, nil
+	}
+
 	// First, look for a .passwd.txt, the file is protected if it is found.
 	passwdFile, err := findAuthFile(auth.filesystem, filename)
 	if err != nil {
@@ -141,10 +201,17 @@ func (auth *BasicAuthenticator) Authenticate(filename string, w http.ResponseWri
 	if err != nil {
 		sess, err = auth.store.New(r, "auth")
 	}
-	_, sessAuth := sess.Values[passwdFile]
+	// The name of the user that unlocked the file is kept as the value.
+	sessUser, sessAuth := sess.Values[passwdFile]
 
 	// Not authenticated? Check for username and password.
 	if !sessAuth {
+		// The credentials have been checked before but the second factor is
+		// still missing.
+		if user, ok := sess.Values[totpPendingKey(passwdFile)].(string); ok {
+			return false, auth.secondFactorRequired(passwdFile, user, sess, w, r)
+		}
+
 		time.Sleep(time.Millisecond * 200) // Mitigate brute force attack.
 
 		if rUsername, rPassword, ok := r.BasicAuth(); ok {
@@ -154,10 +221,20 @@ func (auth *BasicAuthenticator) Authenticate(filename string, w http.ResponseWri
 			}
 
 			if authenticated {
-				sess.Values[passwdFile] = true
+				if needTOTP, err := requiresTOTP(passwdFile); err != nil {
+					return false, err
+				} else if needTOTP {
+					sess.Values[totpPendingKey(passwdFile)] = rUsername
+					return false, auth.secondFactorRequired(passwdFile, rUsername, sess, w, r)
+				}
+
+				sess.Values[passwdFile] = rUsername
 				sess.Save(r, w)
+				auditIdentity(r, rUsername)
 				return true, nil
 			}
+			auditAuthFailed(r, rUsername)
+			metrics.AuthFailures.WithLabelValues("password").Inc()
 		}
 
 		// Prompt the user if none found.
@@ -167,6 +244,134 @@ func (auth *BasicAuthenticator) Authenticate(filename string, w http.ResponseWri
 	}
 
 	// The file has been authenticated by the session.
+	user, _ := sessUser.(string)
+	auditIdentity(r, user)
+	return true, nil
+}
+
+func totpPendingKey(passwdFile string) string {
+	return "totp-pending:" + passwdFile
+}
+
+func totpEnrollKey(passwdFile string) string {
+	return "totp-enroll:" + passwdFile
+}
+
+func totpRecoveryKey(passwdFile string) string {
+	return "totp-recovery:" + passwdFile
+}
+
+// secondFactorRequired builds the error that prompts the user for a TOTP code.
+// If the user has not enrolled yet, a new secret is generated and kept in the
+// session until it is confirmed with a valid code.
+func (auth *BasicAuthenticator) secondFactorRequired(passwdFile, user string, sess *sessions.Session, w http.ResponseWriter, r *http.Request) error {
+	users, err := readTOTPFile(totpFile(passwdFile))
+	if err != nil {
+		return err
+	}
+	if _, ok := users[user]; ok {
+		if err := sess.Save(r, w); err != nil {
+			return err
+		}
+		return &SecondFactorRequired{User: user}
+	}
+
+	secret, ok := sess.Values[totpEnrollKey(passwdFile)].(string)
+	recoveryCodes, _ := sess.Values[totpRecoveryKey(passwdFile)].([]string)
+	if !ok {
+		if secret, err = generateTOTPSecret(); err != nil {
+			return err
+		}
+		if recoveryCodes, err = generateRecoveryCodes(); err != nil {
+			return err
+		}
+		sess.Values[totpEnrollKey(passwdFile)] = secret
+		sess.Values[totpRecoveryKey(passwdFile)] = recoveryCodes
+	}
+	if err := sess.Save(r, w); err != nil {
+		return err
+	}
+
+	account := fmt.Sprintf("%s@%s", user, filepath.Base(filepath.Dir(passwdFile)))
+	enrollment, err := newTOTPEnrollment("webfs", account, secret, recoveryCodes)
+	if err != nil {
+		return err
+	}
+	return &SecondFactorRequired{User: user, Enrollment: enrollment}
+}
+
+func (auth *BasicAuthenticator) VerifySecondFactor(filename, code string, w http.ResponseWriter, r *http.Request) (bool, error) {
+	passwdFile, err := findAuthFile(auth.filesystem, filename)
+	if err != nil {
+		return false, err
+	}
+	if passwdFile == "" {
+		return true, nil
+	}
+
+	sess, err := auth.store.Get(r, "auth")
+	if err != nil {
+		return false, fmt.Errorf("error getting session: %v", err)
+	}
+	user, ok := sess.Values[totpPendingKey(passwdFile)].(string)
+	if !ok {
+		// The first factor has to be passed first.
+		return false, nil
+	}
+
+	time.Sleep(time.Millisecond * 200) // Mitigate brute force attack.
+
+	filename = totpFile(passwdFile)
+	// Accepting a code or recovery code updates the file, which must not race
+	// with other logins of the same directory.
+	unlock := lockTOTPFile(filename)
+	defer unlock()
+	users, err := readTOTPFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	if enrolled, ok := users[user]; ok {
+		if counter, ok := verifyTOTP(enrolled.Secret, code, enrolled.LastCounter, time.Now()); ok {
+			enrolled.LastCounter = counter
+		} else if !enrolled.useRecoveryCode(code) {
+			auditAuthFailed(r, user)
+			metrics.AuthFailures.WithLabelValues("totp").Inc()
+			return false, nil
+		}
+		if err := writeTOTPFile(filename, users); err != nil {
+			return false, err
+		}
+	} else {
+		var counter uint64
+		secret, ok := sess.Values[totpEnrollKey(passwdFile)].(string)
+		if ok {
+			counter, ok = verifyTOTP(secret, code, 0, time.Now())
+		}
+		if !ok {
+			auditAuthFailed(r, user)
+			metrics.AuthFailures.WithLabelValues("totp").Inc()
+			return false, nil
+		}
+		recoveryCodes, _ := sess.Values[totpRecoveryKey(passwdFile)].([]string)
+		hashes := make([]string, len(recoveryCodes))
+		for i, c := range recoveryCodes {
+			hashes[i] = hashRecoveryCode(c)
+		}
+		users[user] = &totpUser{Secret: secret, Recovery: hashes, LastCounter: counter}
+		if err := writeTOTPFile(filename, users); err != nil {
+			return false, err
+		}
+		delete(sess.Values, totpEnrollKey(passwdFile))
+		delete(sess.Values, totpRecoveryKey(passwdFile))
+	}
+
+	delete(sess.Values, totpPendingKey(passwdFile))
+	sess.Values[passwdFile] = user
+	auditIdentity(r, user)
+	if err := sess.Save(r, w); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -180,6 +385,15 @@ func (auth *BasicAuthenticator) FSAuthenticator(r *http.Request) fs.Authenticato
 		if filename == "/home/polyfloyd/Projects/webfs/testdata/home/polyfloyd/Projects/webfs/testdata" {
 			panic(filename)
 		}
+		switch access, err := auth.checkAccess(filename, r); {
+		case err != nil:
+			return err
+		case access == accessDenied:
+			return fs.ErrAccessDenied
+		case access == accessGranted:
+			return nil
+		}
+
 		passwdFile, err := findAuthFile(auth.filesystem, filename)
 		if err != nil {
 			return err
@@ -191,9 +405,12 @@ func (auth *BasicAuthenticator) FSAuthenticator(r *http.Request) fs.Authenticato
 		if err != nil {
 			return fmt.Errorf("error getting session: %v", err)
 		}
-		if _, sessAuth := sess.Values[passwdFile]; !sessAuth {
+		sessUser, sessAuth := sess.Values[passwdFile]
+		if !sessAuth {
 			return fs.ErrNeedAuthentication
 		}
+		user, _ := sessUser.(string)
+		auditIdentity(r, user)
 		return nil
 	})
 }
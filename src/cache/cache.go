@@ -5,8 +5,12 @@ import (
 	"io"
 	"os"
 	"time"
+
+	"webfs/src/logging"
 )
 
+var logger = logging.Component("cache")
+
 type ReadSeekCloser interface {
 	io.Closer
 	io.Reader
@@ -34,6 +38,22 @@ type Cache interface {
 	// Removes a cached file. If the instance identifier is "" all instances
 	// are removed. This function is a no-op if no file exists.
 	Destroy(filename string, instance string) error
+
+	// Reports the usage of the cache.
+	Stats() Stats
+
+	// Waits for all files that are being stored by Put() to be written and
+	// releases the resources held by the cache.
+	Close() error
+}
+
+// Stats describes the usage of a cache.
+type Stats struct {
+	// The number of calls to Get() that did and did not find a file.
+	Hits, Misses uint64
+	Entries      int
+	// The total size of all cached files in bytes.
+	Size int64
 }
 
 func CacheFile(cache Cache, filename, instance string, getContents func(string, io.Writer) error) (ReadSeekCloser, time.Time, error) {
@@ -60,7 +80,12 @@ func CacheFile(cache Cache, filename, instance string, getContents func(string,
 			cache.Destroy(filename, instance)
 			return nil, time.Time{}, err
 		}
-		cacheWriter.Close()
+		if err := cacheWriter.Close(); err != nil {
+			// The contents are still served, they are generated again
+			// on the next request.
+			logger.Error("Could not store file in cache", "file", filename, "instance", instance, "err", err)
+			cache.Destroy(filename, instance)
+		}
 
 		buf.Reader = bytes.NewReader(buf.buf.Bytes())
 		return buf, info.ModTime(), nil
@@ -4,20 +4,34 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"webfs/src/cache"
+	"webfs/src/logging"
 )
 
+var logger = logging.Component("cache")
+
+// Files are written to a temporary file with this suffix first and renamed
+// once complete, so interrupted writes never end up in the cache.
+const tempSuffix = ".tmp"
+
 // A cache using the filesystem as storage.
 type ThumbFileCache struct {
-	dir   string
-	perm  os.FileMode
-	lock  sync.RWMutex
-	locks map[string]*sync.RWMutex
+	hits, misses uint64
+
+	dir     string
+	perm    os.FileMode
+	lock    sync.RWMutex
+	locks   map[string]*sync.RWMutex
+	sizes   map[string]int64
+	writers sync.WaitGroup
 }
 
 func NewCache(dir string, perm os.FileMode) (*ThumbFileCache, error) {
@@ -33,6 +47,7 @@ func NewCache(dir string, perm os.FileMode) (*ThumbFileCache, error) {
 		dir:   dir,
 		perm:  perm,
 		locks: map[string]*sync.RWMutex{},
+		sizes: map[string]int64{},
 	}
 
 	fd, err := os.Open(cache.dir)
@@ -40,13 +55,23 @@ func NewCache(dir string, perm os.FileMode) (*ThumbFileCache, error) {
 		return nil, err
 	}
 	defer fd.Close()
-	filenames, err := fd.Readdirnames(-1)
+	infos, err := fd.Readdir(-1)
 	if err != nil {
 		return nil, err
 	}
-	for _, name := range filenames {
-		cache.locks[path.Join(dir, name)] = &sync.RWMutex{}
+	for _, info := range infos {
+		// Remove leftovers of writes that were interrupted.
+		if strings.HasSuffix(info.Name(), tempSuffix) {
+			logger.Debug("Removing interrupted write", "file", info.Name())
+			if err := os.Remove(path.Join(dir, info.Name())); err != nil {
+				logger.Warn("Could not remove interrupted write", "file", info.Name(), "err", err)
+			}
+			continue
+		}
+		cache.locks[path.Join(dir, info.Name())] = &sync.RWMutex{}
+		cache.sizes[path.Join(dir, info.Name())] = info.Size()
 	}
+	logger.Debug("Opened file cache", "dir", dir, "entries", len(cache.sizes))
 
 	return cache, nil
 }
@@ -58,8 +83,10 @@ func (cache *ThumbFileCache) Get(filename string, instance string) (cache.ReadSe
 	defer cache.lock.RUnlock()
 	lock, ok := cache.locks[cacheFile]
 	if !ok {
+		atomic.AddUint64(&cache.misses, 1)
 		return nil, time.Time{}, nil
 	}
+	atomic.AddUint64(&cache.hits, 1)
 	lock.RLock()
 
 	fd, err := os.Open(cacheFile)
@@ -89,14 +116,31 @@ func (cache *ThumbFileCache) Put(filename string, instance string) (io.WriteClos
 	lock.Lock()
 	cache.locks[cacheFile] = lock
 
-	fd, err := os.OpenFile(cacheFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cache.perm)
+	fd, err := ioutil.TempFile(cache.dir, path.Base(cacheFile)+".*"+tempSuffix)
 	if err != nil {
+		delete(cache.locks, cacheFile)
+		lock.Unlock()
+		return nil, err
+	}
+	if err := fd.Chmod(cache.perm.Perm()); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		delete(cache.locks, cacheFile)
+		lock.Unlock()
 		return nil, err
 	}
 
-	return fileReleaser{
-		File: fd,
-		lock: lock,
+	cache.writers.Add(1)
+	return &fileCommitter{
+		File:   fd,
+		target: cacheFile,
+		lock:   lock,
+		committed: func(size int64) {
+			cache.lock.Lock()
+			cache.sizes[cacheFile] = size
+			cache.lock.Unlock()
+		},
+		done: cache.writers.Done,
 	}, nil
 }
 
@@ -110,8 +154,31 @@ func (cache *ThumbFileCache) Destroy(filename string, instance string) error {
 		lock.Lock()
 		delete(cache.locks, cacheFile)
 	}
+	delete(cache.sizes, cacheFile)
+
+	if err := os.Remove(cacheFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *ThumbFileCache) Stats() cache.Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	stats := cache.Stats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: len(c.sizes),
+	}
+	for _, size := range c.sizes {
+		stats.Size += size
+	}
+	return stats
+}
 
-	return os.Remove(cacheFile)
+func (cache *ThumbFileCache) Close() error {
+	cache.writers.Wait()
+	return nil
 }
 
 func (cache *ThumbFileCache) filename(filename string, instance string) string {
@@ -127,3 +194,35 @@ func (fr fileReleaser) Close() error {
 	defer fr.lock.Unlock()
 	return fr.File.Close()
 }
+
+// fileCommitter moves the temporary file it writes to into place when it is
+// closed.
+type fileCommitter struct {
+	*os.File
+	target    string
+	lock      sync.Locker
+	committed func(size int64)
+	done      func()
+}
+
+func (fc *fileCommitter) Close() error {
+	defer fc.done()
+	info, err := fc.File.Stat()
+	if cerr := fc.File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fc.File.Name(), fc.target)
+	}
+	if err != nil {
+		os.Remove(fc.File.Name())
+	}
+	// The cache lock must not be acquired while holding the lock of the
+	// file, Get() does the opposite.
+	fc.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	fc.committed(info.Size())
+	return nil
+}
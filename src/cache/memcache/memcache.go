@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"webfs/src/cache"
@@ -15,6 +16,8 @@ import (
 // It's better not to use this when we have need to serve a metric crapload of
 // files.
 type MemCache struct {
+	hits, misses uint64
+
 	store map[string]*cachedFile
 	lock  sync.RWMutex
 }
@@ -30,8 +33,10 @@ func (cache *MemCache) Get(filename string, instance string) (cache.ReadSeekClos
 	cachedFile, ok := cache.store[cacheKey(filename, instance)]
 	cache.lock.RUnlock()
 	if !ok {
+		atomic.AddUint64(&cache.misses, 1)
 		return nil, time.Time{}, nil
 	}
+	atomic.AddUint64(&cache.hits, 1)
 
 	// Wait if the file is being written. The lock will be released by the
 	// Close() function of cachedFileReader.
@@ -77,7 +82,28 @@ func (cache *MemCache) Destroy(filename string, instance string) error {
 	return nil
 }
 
+func (c *MemCache) Stats() cache.Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	stats := cache.Stats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: len(c.store),
+	}
+	for _, cachedFile := range c.store {
+		stats.Size += atomic.LoadInt64(&cachedFile.size)
+	}
+	return stats
+}
+
+func (cache *MemCache) Close() error {
+	return nil
+}
+
 type cachedFile struct {
+	// Set once the file has been written.
+	size int64
+
 	buf     bytes.Buffer
 	modTime time.Time
 	lock    sync.RWMutex
@@ -103,6 +129,7 @@ type cachedFileWriter struct {
 }
 
 func (writer cachedFileWriter) Close() error {
+	atomic.StoreInt64(&writer.file.size, int64(writer.Len()))
 	writer.file.lock.Unlock()
 	return nil
 }
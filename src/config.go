@@ -0,0 +1,660 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"webfs/src/logging"
+)
+
+// Config holds all settings of webfs. It can be loaded from a TOML file, any
+// flag that is explicitly set on the command line takes precedence.
+//
+// The urlroot, shutdown timeout, admin, thumbnail dimensions, log, map and ui
+// settings are applied when the daemon receives SIGHUP, all other settings
+// require a restart.
+type Config struct {
+	Listen         []string `toml:"listen"`
+	URLRoot        string   `toml:"urlroot"`
+	BasePath       string   `toml:"base_path"`
+	Mount          string   `toml:"mount"`
+	CacheDir       string   `toml:"cache_dir"`
+	AssetsDir      string   `toml:"assets_dir"`
+	TrustedProxies []string `toml:"trusted_proxies"`
+	// The permissions and group of Unix domain sockets that are listened on.
+	SocketMode  string `toml:"socket_mode"`
+	SocketGroup string `toml:"socket_group"`
+	// ShutdownTimeout is how long active requests may take to complete
+	// when the daemon is stopped or restarted.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+
+	TLS       TLSConfig       `toml:"tls"`
+	Auth      AuthConfig      `toml:"auth"`
+	Admin     AdminConfig     `toml:"admin"`
+	Thumbnail ThumbnailConfig `toml:"thumbnail"`
+	Audit     AuditConfig     `toml:"audit"`
+	Metrics   MetricsConfig   `toml:"metrics"`
+	Log       LogConfig       `toml:"log"`
+	Map       MapConfig       `toml:"map"`
+	UI        UIConfig        `toml:"ui"`
+}
+
+type TLSConfig struct {
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+	// Redirect is the address of a plain HTTP listener that redirects all
+	// requests to HTTPS.
+	Redirect string     `toml:"redirect"`
+	ACME     ACMEConfig `toml:"acme"`
+}
+
+// Enabled reports whether connections should be served using TLS.
+func (c *TLSConfig) Enabled() bool {
+	return c.Cert != "" || len(c.ACME.Domains) > 0
+}
+
+type ACMEConfig struct {
+	Domains []string `toml:"domains"`
+	Email   string   `toml:"email"`
+	// The directory URL of the CA, Let's Encrypt is used if empty.
+	Directory string `toml:"directory"`
+	// A PEM file with the root certificates to trust when connecting to
+	// the directory, e.g. of a local test CA.
+	DirectoryCA string `toml:"directory_ca"`
+}
+
+type AuthConfig struct {
+	// Only available in debug builds.
+	NoPasswd bool `toml:"nopasswd"`
+}
+
+type AdminConfig struct {
+	// A file in the format of .passwd.txt with the users that may access
+	// the admin status page. The page is disabled if empty.
+	PasswdFile string `toml:"passwd_file"`
+}
+
+type ThumbnailConfig struct {
+	Width       int  `toml:"width"`
+	Height      int  `toml:"height"`
+	Pregenerate bool `toml:"pregenerate"`
+}
+
+type AuditConfig struct {
+	File    string `toml:"file"`
+	MaxSize int64  `toml:"max_size"`
+	Backups int    `toml:"backups"`
+	Syslog  bool   `toml:"syslog"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Addr is the address of a separate listener that serves /metrics
+	// without authentication. Without it, /metrics is served by the main
+	// listeners to the users of the admin password file.
+	Addr string `toml:"addr"`
+}
+
+// MapConfig sets the tile server of the map of geotagged photos.
+type MapConfig struct {
+	// The URL of the map tiles with {z}, {x} and {y} placeholders, e.g.
+	// https://tiles.example.com/{z}/{x}/{y}.png or a path served by webfs.
+	TileURL string `toml:"tile_url"`
+	// The copyright notice of the tiles, shown on the map.
+	Attribution string `toml:"attribution"`
+	MaxZoom     int    `toml:"max_zoom"`
+}
+
+// tileOrigin returns the origin of the tile server, or "" if the tiles are
+// served by webfs itself.
+func (c *MapConfig) tileOrigin() string {
+	u, err := url.Parse(c.TileURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+type LogConfig struct {
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+	// Overrides the level of specific components, e.g. {thumb = "error"}.
+	Components map[string]string `toml:"components"`
+}
+
+// logging converts the configuration to the form used by the logging package.
+func (c *LogConfig) logging() (logging.Config, error) {
+	level, err := logging.ParseLevel(c.Level)
+	if err != nil {
+		return logging.Config{}, fmt.Errorf("level: %v", err)
+	}
+	config := logging.Config{
+		Format:     c.Format,
+		Level:      level,
+		Components: map[string]slog.Level{},
+	}
+	for name, l := range c.Components {
+		level, err := logging.ParseLevel(l)
+		if err != nil {
+			return logging.Config{}, fmt.Errorf("components.%s: %v", name, err)
+		}
+		config.Components[name] = level
+	}
+	return config, nil
+}
+
+// configureLogging applies the log settings to all loggers.
+func configureLogging(c LogConfig) error {
+	config, err := c.logging()
+	if err != nil {
+		return err
+	}
+	return logging.Configure(config, os.Stderr)
+}
+
+type UIConfig struct {
+	PiwikRoot   string `toml:"piwik_root"`
+	PiwikSiteID int    `toml:"piwik_site"`
+
+	// The name of the site, shown in the title of every page.
+	Title string `toml:"title"`
+	// The URL path of an image shown in the header, e.g. a public file
+	// in the assets directory.
+	Logo string `toml:"logo"`
+	// HTML that replaces the copyright notice in the footer.
+	Footer string       `toml:"footer"`
+	Colors ColorsConfig `toml:"colors"`
+	// The number of files on a page of a directory listing, 0 to list all
+	// files at once.
+	PageSize int `toml:"page_size"`
+	// How long each file is shown when playing a slideshow.
+	SlideshowInterval time.Duration `toml:"slideshow_interval"`
+	// Where the README of a directory is shown: above or below the listing,
+	// or hidden.
+	Readme string `toml:"readme"`
+}
+
+// ColorsConfig holds CSS colors that replace those of the built-in style.
+// Colors that are not set keep their default.
+type ColorsConfig struct {
+	Primary     string `toml:"primary"`
+	PrimaryDark string `toml:"primary_dark"`
+	Accent      string `toml:"accent"`
+	HeaderText  string `toml:"header_text"`
+	Background  string `toml:"background"`
+	Text        string `toml:"text"`
+}
+
+// cssColor matches the notations of colors that can be safely put in a style
+// sheet.
+var cssColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+|(rgb|rgba|hsl|hsla)\([0-9.,%\s]+\))$`)
+
+// properties maps the CSS custom properties used by the style to the
+// configured colors.
+func (c *ColorsConfig) properties() map[string]string {
+	return map[string]string{
+		"--fs-primary":      c.Primary,
+		"--fs-primary-dark": c.PrimaryDark,
+		"--fs-accent":       c.Accent,
+		"--fs-header-text":  c.HeaderText,
+		"--fs-background":   c.Background,
+		"--fs-text":         c.Text,
+	}
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:          []string{"localhost:8080"},
+		Mount:           ".",
+		CacheDir:        filepath.Join(os.TempDir(), fmt.Sprintf("webfs-%d", os.Getuid())),
+		SocketMode:      "0660",
+		ShutdownTimeout: 30 * time.Second,
+		Thumbnail: ThumbnailConfig{
+			Width:  140,
+			Height: 140,
+		},
+		Audit: AuditConfig{
+			MaxSize: 100,
+			Backups: 5,
+		},
+		UI: UIConfig{
+			Title:             "webfs",
+			PageSize:          200,
+			SlideshowInterval: 5 * time.Second,
+			Readme:            "below",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Map: MapConfig{
+			MaxZoom: 18,
+		},
+	}
+}
+
+// stringList is a flag.Value for settings holding multiple strings, the
+// values are separated by commas.
+type stringList struct {
+	list *[]string
+}
+
+func (sl stringList) String() string {
+	if sl.list == nil {
+		return ""
+	}
+	return strings.Join(*sl.list, ",")
+}
+
+func (sl stringList) Set(s string) error {
+	*sl.list = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*sl.list = append(*sl.list, v)
+		}
+	}
+	return nil
+}
+
+// componentLevels is a flag.Value for the levels of log components, written
+// as comma separated component=level pairs.
+type componentLevels struct {
+	levels *map[string]string
+}
+
+func (cl componentLevels) String() string {
+	if cl.levels == nil {
+		return ""
+	}
+	var pairs []string
+	for name, level := range *cl.levels {
+		pairs = append(pairs, name+"="+level)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (cl componentLevels) Set(s string) error {
+	levels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, level, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%q is not of the form component=level", pair)
+		}
+		levels[strings.TrimSpace(name)] = strings.TrimSpace(level)
+	}
+	*cl.levels = levels
+	return nil
+}
+
+// RegisterFlags binds the command line flags to the configuration.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(stringList{&c.Listen}, "listen", "Comma separated `addresses` to listen on for HTTP connections, unix:/path for Unix domain sockets")
+	fs.StringVar(&c.SocketMode, "socket-mode", c.SocketMode, "The octal permission `mode` of Unix domain sockets")
+	fs.StringVar(&c.SocketGroup, "socket-group", c.SocketGroup, "The `group` that owns Unix domain sockets")
+	fs.StringVar(&c.URLRoot, "urlroot", c.URLRoot, "The absolute URL of the HTTP root, must not end with a slash. If empty, it is derived from each request")
+	fs.StringVar(&c.BasePath, "base-path", c.BasePath, "The `path` under which all routes are mounted, e.g. /files")
+	fs.StringVar(&c.Mount, "mount", c.Mount, "The root directory to expose")
+	fs.StringVar(&c.CacheDir, "cache-dir", c.CacheDir, "The directory to store generated thumbnails. If empty, all files are kept in memory")
+	fs.StringVar(&c.AssetsDir, "assets-dir", c.AssetsDir, "A `directory` with templates and public files that override the built-in ones")
+	fs.Var(stringList{&c.TrustedProxies}, "trusted-proxies", "Comma separated `addresses` or CIDR networks of reverse proxies whose X-Forwarded-* headers are trusted, unix for peers on Unix domain sockets")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "How long to wait for active requests to complete when stopping or restarting")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "The PEM encoded TLS certificate `file`, it is reloaded when it changes")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "The PEM encoded TLS private key `file`")
+	fs.StringVar(&c.TLS.Redirect, "tls-redirect", c.TLS.Redirect, "The `address` to listen on for plain HTTP connections that are redirected to HTTPS")
+	fs.Var(stringList{&c.TLS.ACME.Domains}, "acme-domains", "Comma separated `domains` to obtain TLS certificates for using ACME")
+	fs.StringVar(&c.TLS.ACME.Email, "acme-email", c.TLS.ACME.Email, "The contact email address for the ACME account")
+	fs.StringVar(&c.TLS.ACME.Directory, "acme-directory", c.TLS.ACME.Directory, "The directory `URL` of the ACME CA (default Let's Encrypt)")
+	fs.StringVar(&c.TLS.ACME.DirectoryCA, "acme-directory-ca", c.TLS.ACME.DirectoryCA, "A PEM `file` with the root certificates to trust for the ACME directory")
+	if build == "debug" {
+		fs.BoolVar(&c.Auth.NoPasswd, "nopasswd", c.Auth.NoPasswd, "Globally disable passord protection (debug builds only)")
+	}
+	fs.StringVar(&c.Admin.PasswdFile, "admin-passwd", c.Admin.PasswdFile, "A password `file` with the users that may access the admin status page at /admin")
+	fs.BoolVar(&c.Thumbnail.Pregenerate, "pregen-thumbs", c.Thumbnail.Pregenerate, "Generate thumbnails for every file in all configured filesystems on startup")
+	fs.StringVar(&c.Audit.File, "audit-log", c.Audit.File, "The file to write the audit log of accesses and downloads to")
+	fs.Int64Var(&c.Audit.MaxSize, "audit-log-max-size", c.Audit.MaxSize, "The size in MiB after which the audit log file is rotated")
+	fs.IntVar(&c.Audit.Backups, "audit-log-backups", c.Audit.Backups, "The number of rotated audit log files to keep")
+	fs.BoolVar(&c.Audit.Syslog, "audit-syslog", c.Audit.Syslog, "Send the audit log to syslog")
+	fs.BoolVar(&c.Metrics.Enabled, "metrics", c.Metrics.Enabled, "Expose Prometheus metrics at /metrics to the users of -admin-passwd")
+	fs.StringVar(&c.Metrics.Addr, "metrics-addr", c.Metrics.Addr, "The `address` to listen on for unauthenticated requests of /metrics instead")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "The minimum `level` of logged messages: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "The log `format`: text or json")
+	fs.Var(componentLevels{&c.Log.Components}, "log-components", "Comma separated component=level `pairs` overriding the log level of components, e.g. thumb=error")
+	fs.StringVar(&c.Map.TileURL, "map-tile-url", c.Map.TileURL, "The `URL` of the map tiles with {z}, {x} and {y} placeholders, the map of geotagged photos has no background if empty")
+	fs.StringVar(&c.Map.Attribution, "map-attribution", c.Map.Attribution, "The copyright notice of the map tiles")
+	fs.StringVar(&c.UI.PiwikRoot, "piwik-root", c.UI.PiwikRoot, "The HTTP root of a Piwik installation, must not end with a slash")
+	fs.IntVar(&c.UI.PiwikSiteID, "piwik-site", c.UI.PiwikSiteID, "The Piwik Site ID")
+	fs.StringVar(&c.UI.Title, "site-title", c.UI.Title, "The name of the site, shown in the title of every page")
+	fs.StringVar(&c.UI.Logo, "site-logo", c.UI.Logo, "The URL `path` of an image to show in the header, e.g. /logo.png")
+	fs.StringVar(&c.UI.Footer, "site-footer", c.UI.Footer, "The `HTML` to show in the footer instead of the copyright notice")
+	fs.DurationVar(&c.UI.SlideshowInterval, "slideshow-interval", c.UI.SlideshowInterval, "How long each file is shown when playing a slideshow")
+	fs.IntVar(&c.UI.PageSize, "page-size", c.UI.PageSize, "The number of files shown at once in a directory listing, more are loaded while scrolling. 0 shows all files")
+	fs.StringVar(&c.UI.Readme, "readme", c.UI.Readme, "Where the README.md or README.txt of a directory is shown: `above`, below or hidden")
+}
+
+// applyFlags copies the settings of the flags that were set on the command
+// line from flags into the configuration.
+func (c *Config) applyFlags(fs *flag.FlagSet, flags *Config) {
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = flags.Listen
+		case "urlroot":
+			c.URLRoot = flags.URLRoot
+		case "base-path":
+			c.BasePath = flags.BasePath
+		case "mount":
+			c.Mount = flags.Mount
+		case "cache-dir":
+			c.CacheDir = flags.CacheDir
+		case "assets-dir":
+			c.AssetsDir = flags.AssetsDir
+		case "trusted-proxies":
+			c.TrustedProxies = flags.TrustedProxies
+		case "socket-mode":
+			c.SocketMode = flags.SocketMode
+		case "socket-group":
+			c.SocketGroup = flags.SocketGroup
+		case "shutdown-timeout":
+			c.ShutdownTimeout = flags.ShutdownTimeout
+		case "tls-cert":
+			c.TLS.Cert = flags.TLS.Cert
+		case "tls-key":
+			c.TLS.Key = flags.TLS.Key
+		case "tls-redirect":
+			c.TLS.Redirect = flags.TLS.Redirect
+		case "acme-domains":
+			c.TLS.ACME.Domains = flags.TLS.ACME.Domains
+		case "acme-email":
+			c.TLS.ACME.Email = flags.TLS.ACME.Email
+		case "acme-directory":
+			c.TLS.ACME.Directory = flags.TLS.ACME.Directory
+		case "acme-directory-ca":
+			c.TLS.ACME.DirectoryCA = flags.TLS.ACME.DirectoryCA
+		case "nopasswd":
+			c.Auth.NoPasswd = flags.Auth.NoPasswd
+		case "admin-passwd":
+			c.Admin.PasswdFile = flags.Admin.PasswdFile
+		case "pregen-thumbs":
+			c.Thumbnail.Pregenerate = flags.Thumbnail.Pregenerate
+		case "audit-log":
+			c.Audit.File = flags.Audit.File
+		case "audit-log-max-size":
+			c.Audit.MaxSize = flags.Audit.MaxSize
+		case "audit-log-backups":
+			c.Audit.Backups = flags.Audit.Backups
+		case "audit-syslog":
+			c.Audit.Syslog = flags.Audit.Syslog
+		case "metrics":
+			c.Metrics.Enabled = flags.Metrics.Enabled
+		case "metrics-addr":
+			c.Metrics.Addr = flags.Metrics.Addr
+		case "log-level":
+			c.Log.Level = flags.Log.Level
+		case "log-format":
+			c.Log.Format = flags.Log.Format
+		case "log-components":
+			c.Log.Components = flags.Log.Components
+		case "map-tile-url":
+			c.Map.TileURL = flags.Map.TileURL
+		case "map-attribution":
+			c.Map.Attribution = flags.Map.Attribution
+		case "piwik-root":
+			c.UI.PiwikRoot = flags.UI.PiwikRoot
+		case "piwik-site":
+			c.UI.PiwikSiteID = flags.UI.PiwikSiteID
+		case "site-title":
+			c.UI.Title = flags.UI.Title
+		case "site-logo":
+			c.UI.Logo = flags.UI.Logo
+		case "site-footer":
+			c.UI.Footer = flags.UI.Footer
+		case "page-size":
+			c.UI.PageSize = flags.UI.PageSize
+		case "slideshow-interval":
+			c.UI.SlideshowInterval = flags.UI.SlideshowInterval
+		case "readme":
+			c.UI.Readme = flags.UI.Readme
+		}
+	})
+}
+
+// LoadConfig reads the configuration file, if any, and overrides it with the
+// flags that were explicitly set. The result is validated.
+func LoadConfig(filename string, fs *flag.FlagSet, flags *Config) (*Config, error) {
+	config := DefaultConfig()
+	if filename != "" {
+		meta, err := toml.DecodeFile(filename, &config)
+		if err != nil {
+			return nil, fmt.Errorf("could not load config: %v", err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return nil, fmt.Errorf("%s: unknown settings: %s", filename, strings.Join(keys, ", "))
+		}
+	}
+	config.applyFlags(fs, flags)
+
+	if err := config.Validate(); err != nil {
+		if filename != "" {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		return nil, err
+	}
+	return &config, nil
+}
+
+// tcpListen returns the first address to listen on that is not a Unix domain
+// socket.
+func (c *Config) tcpListen() string {
+	for _, addr := range c.Listen {
+		if !strings.HasPrefix(addr, unixAddressPrefix) {
+			return addr
+		}
+	}
+	return ""
+}
+
+// socketMode returns the parsed SocketMode.
+func (c *Config) socketMode() os.FileMode {
+	mode, _ := strconv.ParseUint(c.SocketMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+func (c *Config) Validate() error {
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("listen: at least one address is required")
+	}
+	for _, addr := range c.Listen {
+		if addr == unixAddressPrefix {
+			return fmt.Errorf("listen: %q: missing socket path", addr)
+		}
+	}
+	if mode, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("socket_mode: %q is not an octal permission mode", c.SocketMode)
+	}
+	if strings.HasSuffix(c.URLRoot, "/") {
+		return fmt.Errorf("urlroot: must not end with a slash")
+	}
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.HasSuffix(c.BasePath, "/")) {
+		return fmt.Errorf("base_path: must start and must not end with a slash")
+	}
+	mount, err := resolveHome(c.Mount)
+	if err != nil {
+		return fmt.Errorf("mount: %v", err)
+	}
+	if info, err := os.Stat(mount); err != nil {
+		return fmt.Errorf("mount: %v", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("mount: %q is not a directory", c.Mount)
+	}
+	if c.AssetsDir != "" {
+		dir, err := resolveHome(c.AssetsDir)
+		if err != nil {
+			return fmt.Errorf("assets_dir: %v", err)
+		}
+		if info, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("assets_dir: %v", err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("assets_dir: %q is not a directory", c.AssetsDir)
+		}
+	}
+	if _, err := ParseTrustedProxies(strings.Join(c.TrustedProxies, ",")); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout: must not be negative")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("tls: cert and key must be set together")
+	}
+	if c.TLS.Cert != "" && len(c.TLS.ACME.Domains) > 0 {
+		return fmt.Errorf("tls: cert and acme can not be used together")
+	}
+	if c.TLS.Redirect != "" && !c.TLS.Enabled() {
+		return fmt.Errorf("tls.redirect: requires a certificate or acme")
+	}
+	if c.Metrics.Addr != "" && !c.Metrics.Enabled {
+		return fmt.Errorf("metrics.addr: requires metrics to be enabled")
+	}
+	if c.Metrics.Enabled && c.Metrics.Addr == "" && c.Admin.PasswdFile == "" {
+		return fmt.Errorf("metrics: requires admin.passwd_file or metrics.addr")
+	}
+	if c.Auth.NoPasswd && build != "debug" {
+		return fmt.Errorf("auth.nopasswd: only available in debug builds")
+	}
+	if c.Thumbnail.Width <= 0 || c.Thumbnail.Height <= 0 {
+		return fmt.Errorf("thumbnail: width and height must be positive")
+	}
+	if c.Thumbnail.Width > 1024 || c.Thumbnail.Height > 1024 {
+		return fmt.Errorf("thumbnail: width and height must not exceed 1024")
+	}
+	if c.Audit.MaxSize < 0 || c.Audit.Backups < 0 {
+		return fmt.Errorf("audit: max_size and backups must not be negative")
+	}
+	if _, err := c.Log.logging(); err != nil {
+		return fmt.Errorf("log.%v", err)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log.format: must be text or json")
+	}
+	if c.Map.TileURL != "" {
+		u, err := url.Parse(c.Map.TileURL)
+		if err != nil {
+			return fmt.Errorf("map.tile_url: %v", err)
+		}
+		if !(u.Scheme == "https" || u.Scheme == "http") && !strings.HasPrefix(c.Map.TileURL, "/") {
+			return fmt.Errorf("map.tile_url: must be an HTTP(S) URL or a path starting with a slash")
+		}
+		for _, placeholder := range []string{"{z}", "{x}", "{y}"} {
+			if !strings.Contains(c.Map.TileURL, placeholder) {
+				return fmt.Errorf("map.tile_url: the %s placeholder is missing", placeholder)
+			}
+		}
+	}
+	if c.Map.MaxZoom < 1 || c.Map.MaxZoom > 22 {
+		return fmt.Errorf("map.max_zoom: must be between 1 and 22")
+	}
+	if strings.HasSuffix(c.UI.PiwikRoot, "/") {
+		return fmt.Errorf("ui.piwik_root: must not end with a slash")
+	}
+	if c.UI.Logo != "" && (!strings.HasPrefix(c.UI.Logo, "/") || strings.HasPrefix(c.UI.Logo, "//")) {
+		return fmt.Errorf("ui.logo: must be a path starting with a slash")
+	}
+	if c.UI.PageSize < 0 {
+		return fmt.Errorf("ui.page_size: must not be negative")
+	}
+	if c.UI.SlideshowInterval <= 0 {
+		return fmt.Errorf("ui.slideshow_interval: must be positive")
+	}
+	if c.UI.Readme != "above" && c.UI.Readme != "below" && c.UI.Readme != "hidden" {
+		return fmt.Errorf("ui.readme: must be above, below or hidden")
+	}
+	for name, color := range c.UI.Colors.properties() {
+		if color != "" && !cssColor.MatchString(color) {
+			key := strings.ReplaceAll(strings.TrimPrefix(name, "--fs-"), "-", "_")
+			return fmt.Errorf("ui.colors.%s: %q is not a valid color", key, color)
+		}
+	}
+	return nil
+}
+
+// restartRequired lists the settings that differ from the other
+// configuration but can not be changed at runtime.
+func (c *Config) restartRequired(other *Config) []string {
+	var changed []string
+	cmp := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	cmp("listen", c.Listen, other.Listen)
+	cmp("base_path", c.BasePath, other.BasePath)
+	cmp("mount", c.Mount, other.Mount)
+	cmp("cache_dir", c.CacheDir, other.CacheDir)
+	cmp("assets_dir", c.AssetsDir, other.AssetsDir)
+	cmp("socket_mode", c.SocketMode, other.SocketMode)
+	cmp("socket_group", c.SocketGroup, other.SocketGroup)
+	cmp("trusted_proxies", c.TrustedProxies, other.TrustedProxies)
+	cmp("tls", c.TLS, other.TLS)
+	cmp("auth", c.Auth, other.Auth)
+	cmp("thumbnail.pregenerate", c.Thumbnail.Pregenerate, other.Thumbnail.Pregenerate)
+	cmp("audit", c.Audit, other.Audit)
+	cmp("metrics", c.Metrics, other.Metrics)
+	sort.Strings(changed)
+	return changed
+}
+
+// withReloaded returns a copy of the configuration with the settings that can
+// be changed at runtime taken from the other configuration.
+func (c *Config) withReloaded(other *Config) *Config {
+	merged := *c
+	merged.URLRoot = other.URLRoot
+	merged.ShutdownTimeout = other.ShutdownTimeout
+	merged.Admin = other.Admin
+	merged.Thumbnail.Width = other.Thumbnail.Width
+	merged.Thumbnail.Height = other.Thumbnail.Height
+	merged.Log = other.Log
+	merged.Map = other.Map
+	merged.UI = other.UI
+	return &merged
+}
+
+// reloadOnSIGHUP loads the configuration every time the process receives
+// SIGHUP and passes it to apply if it is valid.
+func reloadOnSIGHUP(load func() (*Config, error), current func() *Config, apply func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		config, err := load()
+		if err != nil {
+			configLogger.Error("Could not reload configuration", "err", err)
+			continue
+		}
+		for _, name := range config.restartRequired(current()) {
+			configLogger.Warn("Setting has changed, a restart is required to apply it", "setting", name)
+		}
+		apply(current().withReloaded(config))
+		configLogger.Info("Configuration reloaded")
+	}
+}
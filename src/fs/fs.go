@@ -2,9 +2,9 @@ package fs
 
 import (
 	"archive/zip"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -13,13 +13,18 @@ import (
 	"time"
 
 	"webfs/src/cache"
+	"webfs/src/logging"
+	"webfs/src/metrics"
 	"webfs/src/thumb"
 	"webfs/src/thumb/directory"
 )
 
+var logger = logging.Component("fs")
+
 var (
 	ErrFileDoesNotExist   = fmt.Errorf("file does not exist")
 	ErrNeedAuthentication = fmt.Errorf("authentication is needed to access this file")
+	ErrAccessDenied       = fmt.Errorf("access to this file is denied")
 	ErrNoThumbnail        = fmt.Errorf("file has no thumbnail")
 )
 
@@ -46,6 +51,20 @@ func (f File) Name() string {
 type Filesystem struct {
 	mount      string
 	thumbCache cache.Cache
+
+	pregenLock   sync.Mutex
+	pregenStatus PregenerationStatus
+
+	photoCache photoCache
+}
+
+// PregenerationStatus describes the progress of PregenerateThumbnails.
+type PregenerationStatus struct {
+	Running           bool
+	Started, Finished time.Time
+	// The number of files found so far and how many of them have been
+	// processed, including those that failed.
+	Found, Processed, Failed int
 }
 
 func NewFilesystem(mount string, thumbCache cache.Cache) (*Filesystem, error) {
@@ -91,29 +110,11 @@ func (fs *Filesystem) View(path string, auth Authenticator) (interface{}, error)
 		}, nil
 	}
 
-	fd, err := os.Open(filename)
-	if os.IsNotExist(err) {
-		return nil, ErrFileDoesNotExist
-	} else if err != nil {
-		return nil, err
-	}
-	defer fd.Close()
-
-	osFiles, err := fd.Readdir(-1)
+	page, err := fs.List(path, auth, ListOptions{})
 	if err != nil {
 		return nil, err
 	}
-	files := make([]File, 0, len(osFiles))
-	for _, info := range osFiles {
-		if !isDotFile(info.Name()) {
-			files = append(files, File{
-				Info:    info,
-				Path:    filepath.Join(filename, info.Name()),
-				RelPath: filepath.Join(path, info.Name()),
-			})
-		}
-	}
-	return files, nil
+	return page.Files, nil
 }
 
 func (fs *Filesystem) FirstAccessibleParent(path string, auth Authenticator) (string, error) {
@@ -124,7 +125,7 @@ func (fs *Filesystem) FirstAccessibleParent(path string, auth Authenticator) (st
 	for strings.HasPrefix(filename, fs.mount) {
 		if err := auth.IsAuthenticated(filename); err == nil {
 			return strings.TrimPrefix(filename, fs.mount), nil
-		} else if err != ErrNeedAuthentication {
+		} else if err != ErrNeedAuthentication && err != ErrAccessDenied {
 			return "", err
 		}
 		filename = filepath.Dir(filename)
@@ -154,7 +155,7 @@ func (fs *Filesystem) Filepath(path string, auth Authenticator) (string, error)
 	return filename, nil
 }
 
-func (fs *Filesystem) Thumbnail(path string, w, h int, auth Authenticator) (cache.ReadSeekCloser, string, time.Time, error) {
+func (fs *Filesystem) Thumbnail(ctx context.Context, path string, w, h int, auth Authenticator) (cache.ReadSeekCloser, string, time.Time, error) {
 	filename := fs.realPath(path)
 	if isDotFile(filename) {
 		return nil, "", time.Time{}, ErrFileDoesNotExist
@@ -169,7 +170,7 @@ func (fs *Filesystem) Thumbnail(path string, w, h int, auth Authenticator) (cach
 		return nil, "", time.Time{}, err
 	}
 
-	cachedThumb, modTime, err := thumb.ThumbFile(fs.thumbCache, filename, w, h)
+	cachedThumb, modTime, err := thumb.ThumbFile(ctx, fs.thumbCache, filename, w, h)
 	if err != nil {
 		return nil, "", time.Time{}, err
 	} else if cachedThumb == nil {
@@ -195,7 +196,7 @@ func (fs *Filesystem) Zip(path string, wr io.Writer, auth Authenticator) error {
 			return nil
 		}
 
-		if err := auth.IsAuthenticated(path); err == ErrNeedAuthentication {
+		if err := auth.IsAuthenticated(path); err == ErrNeedAuthentication || err == ErrAccessDenied {
 			return nil
 		} else if err != nil {
 			return err
@@ -226,23 +227,39 @@ func (fs *Filesystem) Mount() string {
 	return fs.mount
 }
 
-func (fs *Filesystem) PregenerateThumbnails(w, h int) {
+// PregenerateThumbnails creates thumbnails for all files in the filesystem.
+// It returns once all thumbnails have been generated or ctx is cancelled.
+func (fs *Filesystem) PregenerateThumbnails(ctx context.Context, w, h int) {
 	numRunners := runtime.NumCPU() / 2
 	if numRunners <= 0 {
 		numRunners = 1
 	}
-	log.Printf("Generating thumbnails using %v workers", numRunners)
+	logger.Info("Generating thumbnails", "workers", numRunners)
+	metrics.PregenerationRunning.Set(1)
+	defer metrics.PregenerationRunning.Set(0)
+	fs.updatePregeneration(func(st *PregenerationStatus) {
+		*st = PregenerationStatus{Running: true, Started: time.Now()}
+	})
+	defer fs.updatePregeneration(func(st *PregenerationStatus) {
+		st.Running = false
+		st.Finished = time.Now()
+	})
 
 	fileStream := make(chan string)
 	go func() {
 		defer close(fileStream)
-		log.Printf("Generating thumbs")
 		filepath.Walk(fs.mount, func(path string, info os.FileInfo, err error) error {
 			if path == fs.mount || isDotFile(path) {
 				return nil
 			}
-			fileStream <- path
-			return nil
+			select {
+			case fileStream <- path:
+				metrics.PregenerationFiles.Inc()
+				fs.updatePregeneration(func(st *PregenerationStatus) { st.Found++ })
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		})
 	}()
 
@@ -252,17 +269,43 @@ func (fs *Filesystem) PregenerateThumbnails(w, h int) {
 		go func() {
 			defer wg.Done()
 			for filename := range fileStream {
-				log.Println(filename)
-				if thumb, _, err := thumb.ThumbFile(fs.thumbCache, filename, w, h); err != nil {
-					log.Println(err)
+				logger.Debug("Generating thumbnail", "file", filename)
+				thumb, _, err := thumb.ThumbFile(ctx, fs.thumbCache, filename, w, h)
+				if err != nil {
+					logger.Debug("No thumbnail generated", "file", filename, "err", err)
+					metrics.PregenerationProcessed.WithLabelValues("error").Inc()
 				} else if thumb != nil {
 					thumb.Close()
+					metrics.PregenerationProcessed.WithLabelValues("ok").Inc()
 				}
+				fs.updatePregeneration(func(st *PregenerationStatus) {
+					st.Processed++
+					if err != nil {
+						st.Failed++
+					}
+				})
 			}
 		}()
 	}
 	wg.Wait()
-	log.Printf("Done generating thumbs")
+	if ctx.Err() != nil {
+		logger.Info("Stopped generating thumbnails")
+		return
+	}
+	logger.Info("Done generating thumbnails")
+}
+
+// Pregeneration returns the status of the last run of PregenerateThumbnails.
+func (fs *Filesystem) Pregeneration() PregenerationStatus {
+	fs.pregenLock.Lock()
+	defer fs.pregenLock.Unlock()
+	return fs.pregenStatus
+}
+
+func (fs *Filesystem) updatePregeneration(update func(*PregenerationStatus)) {
+	fs.pregenLock.Lock()
+	update(&fs.pregenStatus)
+	fs.pregenLock.Unlock()
 }
 
 func (fs *Filesystem) RealPath(path string) string {
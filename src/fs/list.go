@@ -0,0 +1,248 @@
+package fs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"webfs/src/thumb"
+)
+
+var (
+	ErrNotDirectory  = fmt.Errorf("file is not a directory")
+	ErrInvalidCursor = fmt.Errorf("invalid cursor")
+)
+
+// ListOptions select the files of a directory that are returned by List and
+// their order.
+type ListOptions struct {
+	// One of "name", "mtime", "size" or "type". Files are sorted by name if
+	// empty. Directories are always listed first.
+	Sort string
+	Desc bool
+	// Only files whose MIME type starts with Type are listed, e.g. "image"
+	// or "directory". All files are listed if empty.
+	Type string
+	// The Next cursor of the previous page, empty for the first page.
+	Cursor string
+	// The maximum number of files on a page, 0 for no limit.
+	Limit int
+}
+
+// A Page is a part of a directory listing.
+type Page struct {
+	Files []File
+	// The position of the first file of the page in the whole listing.
+	Offset int
+	// The number of files in the whole listing.
+	Total int
+	// The cursor of the next page, empty if this is the last page.
+	Next string
+}
+
+// List returns a page of the files in the directory at path.
+//
+// Only the properties of the files needed to sort and filter the listing are
+// read for all files: the names are always known, but the files are only
+// stat'ed when sorting by modification time or size and only sniffed when
+// sorting or filtering by a type that can not be derived from the name. The
+// files on the returned page are always stat'ed.
+//
+// Cursors point at the last file of a page rather than at a position, so
+// files that are added or removed in the meantime do not cause files to be
+// skipped or listed twice.
+func (fs *Filesystem) List(path string, auth Authenticator, opts ListOptions) (Page, error) {
+	filename := fs.realPath(path)
+	if isDotFile(filename) {
+		return Page{}, ErrFileDoesNotExist
+	}
+	if err := auth.IsAuthenticated(filename); err != nil {
+		return Page{}, err
+	}
+
+	fd, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return Page{}, ErrFileDoesNotExist
+	} else if err != nil {
+		return Page{}, err
+	}
+	defer fd.Close()
+	if info, err := fd.Stat(); err != nil {
+		return Page{}, err
+	} else if !info.IsDir() {
+		return Page{}, ErrNotDirectory
+	}
+
+	dirEntries, err := fd.ReadDir(-1)
+	if err != nil {
+		return Page{}, err
+	}
+	entries := make([]*listEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		if isDotFile(d.Name()) {
+			continue
+		}
+		e := &listEntry{Name: d.Name(), Dir: d.IsDir(), dirEntry: d}
+		if err := e.load(filepath.Join(filename, e.Name), opts.needsInfo(), opts.needsType()); os.IsNotExist(err) {
+			continue // Removed while listing.
+		} else if err != nil {
+			return Page{}, err
+		}
+		if opts.Type != "" && !strings.HasPrefix(e.Type, opts.Type) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return opts.compare(entries[i], entries[j]) < 0
+	})
+
+	start := 0
+	if opts.Cursor != "" {
+		last, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return Page{}, err
+		}
+		start = sort.Search(len(entries), func(i int) bool {
+			return opts.compare(entries[i], last) > 0
+		})
+	}
+	end := len(entries)
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+	}
+
+	page := Page{
+		Files:  make([]File, 0, end-start),
+		Offset: start,
+		Total:  len(entries),
+	}
+	for _, e := range entries[start:end] {
+		if err := e.load(filepath.Join(filename, e.Name), true, false); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return Page{}, err
+		}
+		page.Files = append(page.Files, File{
+			Info:    e.info,
+			Path:    filepath.Join(filename, e.Name),
+			RelPath: filepath.Join(path, e.Name),
+		})
+	}
+	if end < len(entries) {
+		page.Next = opts.encodeCursor(entries[end-1])
+	}
+	return page, nil
+}
+
+func (opts ListOptions) needsInfo() bool {
+	return opts.Sort == "mtime" || opts.Sort == "size"
+}
+
+func (opts ListOptions) needsType() bool {
+	return opts.Sort == "type" || opts.Type != ""
+}
+
+// compare orders directories before files, then by the sort key and finally
+// by name.
+func (opts ListOptions) compare(a, b *listEntry) int {
+	if a.Dir != b.Dir {
+		if a.Dir {
+			return -1
+		}
+		return 1
+	}
+	c := 0
+	switch opts.Sort {
+	case "mtime":
+		c = compareInt(a.ModTime, b.ModTime)
+	case "size":
+		c = compareInt(a.Size, b.Size)
+	case "type":
+		c = strings.Compare(a.Type, b.Type)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if opts.Desc {
+		c = -c
+	}
+	return c
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// A listEntry holds the properties of a file that are needed to sort it. The
+// exported fields are also encoded in cursors.
+type listEntry struct {
+	Name    string `json:"n"`
+	Dir     bool   `json:"d,omitempty"`
+	ModTime int64  `json:"m,omitempty"` // In nanoseconds since the epoch.
+	Size    int64  `json:"s,omitempty"`
+	Type    string `json:"t,omitempty"`
+
+	dirEntry os.DirEntry
+	info     os.FileInfo
+}
+
+func (e *listEntry) load(filename string, info, mimeType bool) error {
+	if info && e.info == nil {
+		i, err := e.dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		e.info, e.ModTime, e.Size = i, i.ModTime().UnixNano(), i.Size()
+	}
+	if mimeType && e.Type == "" {
+		if e.Dir {
+			e.Type = "directory"
+		} else {
+			t, err := thumb.MimeType(filename)
+			if err != nil {
+				return err
+			}
+			e.Type = t
+		}
+	}
+	return nil
+}
+
+// encodeCursor encodes the properties of the entry that determine its
+// position in the listing.
+func (opts ListOptions) encodeCursor(e *listEntry) string {
+	key := listEntry{Name: e.Name, Dir: e.Dir}
+	switch opts.Sort {
+	case "mtime":
+		key.ModTime = e.ModTime
+	case "size":
+		key.Size = e.Size
+	case "type":
+		key.Type = e.Type
+	}
+	buf, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(cursor string) (*listEntry, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var e listEntry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &e, nil
+}
@@ -0,0 +1,116 @@
+package fs
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var allowAll = AuthenticatorFunc(func(string) error { return nil })
+
+// newListFilesystem creates a filesystem with the named files, which all have
+// the same size and modification time, and a directory.
+func newListFilesystem(t *testing.T, names ...string) *Filesystem {
+	t.Helper()
+	mount := t.TempDir()
+	modTime := time.Date(2019, 1, 11, 17, 20, 38, 0, time.UTC)
+	for _, name := range names {
+		filename := filepath.Join(mount, name)
+		if err := os.WriteFile(filename, []byte("same"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(mount, "zdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(mount, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestListPagesEqualKeys(t *testing.T) {
+	fs := newListFilesystem(t, "a.txt", "b.txt", "c.txt", "d.txt", "e.txt")
+	tests := []struct {
+		sort string
+		desc bool
+		want []string
+	}{
+		{"name", false, []string{"zdir", "a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}},
+		// Files with equal sort keys are ordered by name, so no file is
+		// skipped or repeated at the boundaries of pages.
+		{"size", false, []string{"zdir", "a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}},
+		{"mtime", false, []string{"zdir", "a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}},
+		{"type", false, []string{"zdir", "a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}},
+		// Directories stay in front when the order is reversed.
+		{"size", true, []string{"zdir", "e.txt", "d.txt", "c.txt", "b.txt", "a.txt"}},
+	}
+	for _, test := range tests {
+		for _, limit := range []int{1, 2, 4} {
+			var names []string
+			opts := ListOptions{Sort: test.sort, Desc: test.desc, Limit: limit}
+			for pages := 0; ; pages++ {
+				if pages > len(test.want) {
+					t.Fatalf("sort=%s desc=%v limit=%d: the listing does not end", test.sort, test.desc, limit)
+				}
+				page, err := fs.List("/", allowAll, opts)
+				if err != nil {
+					t.Fatalf("sort=%s desc=%v limit=%d: %v", test.sort, test.desc, limit, err)
+				}
+				if page.Total != len(test.want) || page.Offset != len(names) {
+					t.Errorf("sort=%s desc=%v limit=%d: page at offset %d of %d, want %d of %d", test.sort, test.desc, limit, page.Offset, page.Total, len(names), len(test.want))
+				}
+				for _, f := range page.Files {
+					names = append(names, f.Name())
+				}
+				if page.Next == "" {
+					break
+				}
+				opts.Cursor = page.Next
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("sort=%s desc=%v limit=%d: listed %v, want %v", test.sort, test.desc, limit, names, test.want)
+			}
+		}
+	}
+}
+
+func TestListInvalidCursor(t *testing.T) {
+	fs := newListFilesystem(t, "a.txt")
+	for _, cursor := range []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"n":1}`)),
+	} {
+		if _, err := fs.List("/", allowAll, ListOptions{Cursor: cursor}); err != ErrInvalidCursor {
+			t.Errorf("List with cursor %q returned %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+func TestListCursorOfRemovedFile(t *testing.T) {
+	fs := newListFilesystem(t, "a.txt", "b.txt", "c.txt")
+	page, err := fs.List("/", allowAll, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last file of the page is removed before the next page is
+	// requested, which continues after it regardless.
+	if err := os.Remove(filepath.Join(fs.Mount(), "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	page, err = fs.List("/", allowAll, ListOptions{Limit: 2, Cursor: page.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Files) != 2 || page.Files[0].Name() != "b.txt" || page.Files[1].Name() != "c.txt" {
+		t.Errorf("the next page holds %v, want b.txt and c.txt", page.Files)
+	}
+}
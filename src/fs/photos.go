@@ -0,0 +1,265 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+
+	"webfs/src/metadata"
+	"webfs/src/thumb"
+)
+
+// photoWalkTTL is how long the photos found by walking a directory tree are
+// reused.
+const photoWalkTTL = time.Minute
+
+// A Photo is an image or video in a directory tree.
+type Photo struct {
+	File
+	MimeType string
+	// The time the photo was taken according to its EXIF data, or its
+	// modification time if it has none.
+	Taken time.Time
+	// Where the photo was taken according to its EXIF data, nil if it is
+	// not known.
+	Location *Location
+}
+
+// A Location is a position on earth in decimal degrees.
+type Location struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+type photoWalk struct {
+	// Closed when the walk has finished, after which photos and err are set.
+	done    chan struct{}
+	created time.Time
+	// All photos in the tree, regardless of whether they are accessible.
+	photos []Photo
+	err    error
+}
+
+type photoCache struct {
+	lock  sync.Mutex
+	walks map[string]*photoWalk
+}
+
+// Timeline returns the images and videos in the directory tree at path that
+// are accessible through auth, the most recent first.
+//
+// The tree is walked at most once per minute, the time and place at which a
+// photo was taken are cached in the shared metadata store.
+func (fs *Filesystem) Timeline(ctx context.Context, path string, auth Authenticator) ([]Photo, error) {
+	return fs.photos(ctx, path, auth)
+}
+
+// Geotagged returns the photos in the directory tree at path that are
+// accessible through auth and have a location, the most recent first.
+func (fs *Filesystem) Geotagged(ctx context.Context, path string, auth Authenticator) ([]Photo, error) {
+	photos, err := fs.photos(ctx, path, auth)
+	if err != nil {
+		return nil, err
+	}
+	geotagged := photos[:0]
+	for _, photo := range photos {
+		if photo.Location != nil {
+			geotagged = append(geotagged, photo)
+		}
+	}
+	return geotagged, nil
+}
+
+func (fs *Filesystem) photos(ctx context.Context, path string, auth Authenticator) ([]Photo, error) {
+	filename := fs.realPath(path)
+	if isDotFile(filename) {
+		return nil, ErrFileDoesNotExist
+	}
+	if err := auth.IsAuthenticated(filename); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, ErrFileDoesNotExist
+	} else if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, ErrNotDirectory
+	}
+
+	all, err := fs.walkPhotos(ctx, filename, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are protected per directory, so the directories are only
+	// checked once.
+	accessible := map[string]bool{}
+	photos := make([]Photo, 0, len(all))
+	for _, photo := range all {
+		dir := filepath.Dir(photo.Path)
+		ok, checked := accessible[dir]
+		if !checked {
+			err := auth.IsAuthenticated(dir)
+			if err != nil && err != ErrNeedAuthentication && err != ErrAccessDenied {
+				return nil, err
+			}
+			ok = err == nil
+			accessible[dir] = ok
+		}
+		if ok {
+			photos = append(photos, photo)
+		}
+	}
+	return photos, nil
+}
+
+// walkPhotos returns the photos in the tree at root. Concurrent requests for
+// the same tree share a single walk, other trees are walked in parallel.
+func (fs *Filesystem) walkPhotos(ctx context.Context, root, rootRel string) ([]Photo, error) {
+	fs.photoCache.lock.Lock()
+	if fs.photoCache.walks == nil {
+		fs.photoCache.walks = map[string]*photoWalk{}
+	}
+	for key, walk := range fs.photoCache.walks {
+		if !walk.created.IsZero() && time.Since(walk.created) > photoWalkTTL {
+			delete(fs.photoCache.walks, key)
+		}
+	}
+	walk, ok := fs.photoCache.walks[root]
+	if !ok {
+		walk = &photoWalk{done: make(chan struct{})}
+		fs.photoCache.walks[root] = walk
+	}
+	fs.photoCache.lock.Unlock()
+
+	if !ok {
+		// The walk is shared, so it is not cancelled along with the
+		// request that started it.
+		photos, err := walkPhotoTree(context.WithoutCancel(ctx), root, rootRel)
+		fs.photoCache.lock.Lock()
+		walk.photos, walk.err = photos, err
+		walk.created = time.Now()
+		if err != nil {
+			delete(fs.photoCache.walks, root)
+		}
+		fs.photoCache.lock.Unlock()
+		close(walk.done)
+	}
+
+	select {
+	case <-walk.done:
+		return walk.photos, walk.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func walkPhotoTree(ctx context.Context, root, rootRel string) ([]Photo, error) {
+	var photos []Photo
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// A directory that can not be read does not spoil the
+			// rest of the tree.
+			logger.WarnContext(ctx, "Could not walk directory", "file", path, "err", err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != root && isDotFile(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		mimeType, err := thumb.MimeType(path)
+		if err != nil {
+			logger.WarnContext(ctx, "Could not determine file type", "file", path, "err", err)
+			return nil
+		}
+		if !strings.HasPrefix(mimeType, "image/") && !strings.HasPrefix(mimeType, "video/") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Removed while walking.
+		}
+		var x photoExif
+		if hasExif(mimeType) {
+			if x, err = metadata.Lookup(metadata.Shared(), path, "exif", readPhotoExif); err != nil {
+				return nil
+			}
+		}
+		if x.Taken.IsZero() {
+			x.Taken = info.ModTime()
+		}
+		photos = append(photos, Photo{
+			File: File{
+				Info:    info,
+				Path:    path,
+				RelPath: filepath.Join(rootRel, strings.TrimPrefix(path, root)),
+			},
+			MimeType: mimeType,
+			Taken:    x.Taken,
+			Location: x.Location,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(photos, func(i, j int) bool {
+		return photos[i].Taken.After(photos[j].Taken)
+	})
+	return photos, nil
+}
+
+// hasExif reports whether files of the type may carry EXIF data. Other files
+// are not decoded, as that involves scanning the whole file.
+func hasExif(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/tiff"
+}
+
+// photoExif holds the facts about a photo that are read from its EXIF data.
+type photoExif struct {
+	// The time the photo was taken, zero if it is not known.
+	Taken time.Time `json:"taken"`
+	// The GPS position at which the photo was taken, nil if it is not
+	// known.
+	Location *Location `json:"location,omitempty"`
+}
+
+// readPhotoExif decodes the EXIF data of a photo. Photos without EXIF data
+// have no facts.
+func readPhotoExif(filename string) (photoExif, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return photoExif{}, err
+	}
+	defer fd.Close()
+	x, err := exif.Decode(fd)
+	if err != nil {
+		return photoExif{}, nil
+	}
+	var facts photoExif
+	if taken, err := x.DateTime(); err == nil {
+		facts.Taken = taken
+	}
+	if lat, long, err := x.LatLong(); err == nil && (lat != 0 || long != 0) {
+		facts.Location = &Location{Lat: lat, Long: long}
+	}
+	return facts, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A readinessCheck verifies that a resource required to serve requests is
+// usable.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// checkReadableDir checks whether the contents of the directory can be listed.
+func checkReadableDir(dir string) func() error {
+	return func() error {
+		fd, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		if _, err := fd.Readdirnames(1); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+}
+
+// checkWritableDir checks whether files can be created in the directory.
+func checkWritableDir(dir string) func() error {
+	return func() error {
+		// The suffix makes sure the file cache removes the file if this
+		// process is killed before it is able to.
+		fd, err := ioutil.TempFile(dir, ".readyz-*.tmp")
+		if err != nil {
+			return err
+		}
+		fd.Close()
+		return os.Remove(fd.Name())
+	}
+}
+
+// healthz reports that the process is alive and handling requests.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, "ok\n")
+}
+
+// readyz reports whether all resources needed to serve requests are usable.
+// The failed checks are listed with status 503.
+func readyz(checks []readinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var failed []string
+		for _, c := range checks {
+			if err := c.check(); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", c.name, err))
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if len(failed) > 0 {
+			serverLogger.WarnContext(r.Context(), "Readiness check failed", "failed", strings.Join(failed, "; "))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, strings.Join(failed, "\n")+"\n")
+			return
+		}
+		io.WriteString(w, "ok\n")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"webfs/src/fs"
+	"webfs/src/thumb/audio"
+)
+
+// templateFuncs are available to all page templates.
+var templateFuncs = template.FuncMap{
+	"add":        func(a, b int) int { return a + b },
+	"escapePath": escapePath,
+	"fileIcon":   fileIcon,
+	"humanSize":  humanSize,
+	"listIcon":   listIcon,
+	"typeClass":  typeClass,
+	"formatTime": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+}
+
+// listingCookieName is the cookie that remembers the view mode and sort order
+// chosen by a user.
+const listingCookieName = "listing"
+
+// maxListingLimit is the largest page of a listing a client can ask for.
+const maxListingLimit = 1000
+
+// listingOptions control how a directory listing is presented.
+type listingOptions struct {
+	// Either "tiles" or "list".
+	View string
+	// One of "name", "mtime", "size" or "type".
+	Sort string
+	// Either "asc" or "desc".
+	Order string
+	// Only files whose MIME type starts with Type are listed, e.g. "image"
+	// or "directory". All files are listed if empty.
+	Type string
+	// Selects the page of the listing, see fs.ListOptions.
+	Cursor string
+	// The number of files on a page if set, overriding the configured page
+	// size. At most maxListingLimit.
+	Limit int
+}
+
+var (
+	listingViews  = []string{"tiles", "list"}
+	listingSorts  = []string{"name", "mtime", "size", "type"}
+	listingOrders = []string{"asc", "desc"}
+	listingTypes  = []string{"directory", "image", "video", "audio", "text", "application"}
+)
+
+func defaultListingOptions() listingOptions {
+	return listingOptions{View: "tiles", Sort: "name", Order: "asc"}
+}
+
+// parseListingOptions reads the listing options from the query of the
+// request, falling back to those remembered in the listing cookie. Invalid
+// values are ignored, except for the cursor which is checked by fs.List. If
+// the query changes the view or the sort order, the cookie is updated.
+func parseListingOptions(w http.ResponseWriter, r *http.Request) listingOptions {
+	opts := defaultListingOptions()
+	if cookie, err := r.Cookie(listingCookieName); err == nil {
+		if values, err := url.ParseQuery(cookie.Value); err == nil {
+			opts.set(values)
+		}
+	}
+	remembered := opts
+	opts.set(r.URL.Query())
+	query := r.URL.Query()
+	if t := query.Get("type"); oneOf(t, listingTypes) {
+		opts.Type = t
+	}
+	opts.Cursor = query.Get("cursor")
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		opts.Limit = min(limit, maxListingLimit)
+	}
+
+	if opts.View != remembered.View || opts.Sort != remembered.Sort || opts.Order != remembered.Order {
+		http.SetCookie(w, &http.Cookie{
+			Name: listingCookieName,
+			Value: url.Values{
+				"view":  {opts.View},
+				"sort":  {opts.Sort},
+				"order": {opts.Order},
+			}.Encode(),
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return opts
+}
+
+func (opts *listingOptions) set(values url.Values) {
+	if v := values.Get("view"); oneOf(v, listingViews) {
+		opts.View = v
+	}
+	if v := values.Get("sort"); oneOf(v, listingSorts) {
+		opts.Sort = v
+	}
+	if v := values.Get("order"); oneOf(v, listingOrders) {
+		opts.Order = v
+	}
+}
+
+// Query returns the query string that selects the options with the sort
+// order changed to the specified key. Sorting by the current key reverses
+// the order.
+func (opts listingOptions) Query(sortKey string) string {
+	order := "asc"
+	if sortKey == opts.Sort && opts.Order == "asc" {
+		order = "desc"
+	}
+	values := url.Values{"sort": {sortKey}, "order": {order}}
+	if opts.Type != "" {
+		values.Set("type", opts.Type)
+	}
+	if opts.Limit > 0 {
+		values.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	return "?" + values.Encode()
+}
+
+// Next returns the query string that selects the page of the listing after
+// cursor.
+func (opts listingOptions) Next(cursor string) string {
+	values := url.Values{"sort": {opts.Sort}, "order": {opts.Order}, "cursor": {cursor}}
+	if opts.Type != "" {
+		values.Set("type", opts.Type)
+	}
+	if opts.Limit > 0 {
+		values.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	return "?" + values.Encode()
+}
+
+// listOptions returns the options to list the page of the directory selected
+// by the cursor. Pages hold at most pageSize files, unless a limit was
+// requested.
+func (opts listingOptions) listOptions(pageSize int) fs.ListOptions {
+	if opts.Limit > 0 {
+		pageSize = opts.Limit
+	}
+	return fs.ListOptions{
+		Sort:   opts.Sort,
+		Desc:   opts.Order == "desc",
+		Type:   opts.Type,
+		Cursor: opts.Cursor,
+		Limit:  pageSize,
+	}
+}
+
+// maxCachedListings is the number of directories whose listingFacts are kept.
+const maxCachedListings = 256
+
+// listingFacts are the properties of a file in a listing that are expensive
+// to determine.
+type listingFacts struct {
+	size     int64
+	modTime  time.Time
+	mimeType string
+	hasThumb bool
+	// The tags of audio files, nil for other files.
+	tags *audio.Tags
+}
+
+// A listingCache keeps the listingFacts of the files in recently listed
+// directories. The facts of a file are dropped when its size or modification
+// time changes, those of a whole directory when files are added to or removed
+// from it, which may change the thumbnail of the files next to them.
+type listingCache struct {
+	lock sync.Mutex
+	dirs map[string]*cachedListing
+}
+
+type cachedListing struct {
+	modTime time.Time
+	used    time.Time
+	files   map[string]listingFacts
+}
+
+// facts returns the facts of a file in the directory dir, which was last
+// modified at dirModTime. If they are not cached, probe is called to
+// determine them. Facts are not cached if probe returns an error.
+func (lc *listingCache) facts(dir string, dirModTime time.Time, file fs.File, probe func() (listingFacts, error)) (listingFacts, error) {
+	name := file.Name()
+	lc.lock.Lock()
+	if listing, ok := lc.dirs[dir]; ok && listing.modTime.Equal(dirModTime) {
+		listing.used = time.Now()
+		if facts, ok := listing.files[name]; ok && facts.size == file.Info.Size() && facts.modTime.Equal(file.Info.ModTime()) {
+			lc.lock.Unlock()
+			return facts, nil
+		}
+	}
+	lc.lock.Unlock()
+
+	facts, err := probe()
+	if err != nil {
+		return facts, err
+	}
+	facts.size, facts.modTime = file.Info.Size(), file.Info.ModTime()
+
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	if lc.dirs == nil {
+		lc.dirs = map[string]*cachedListing{}
+	}
+	listing, ok := lc.dirs[dir]
+	if !ok || !listing.modTime.Equal(dirModTime) {
+		if !ok && len(lc.dirs) >= maxCachedListings {
+			lc.evictOldest()
+		}
+		listing = &cachedListing{modTime: dirModTime, files: map[string]listingFacts{}}
+		lc.dirs[dir] = listing
+	}
+	listing.used = time.Now()
+	listing.files[name] = facts
+	return facts, nil
+}
+
+// evictOldest drops the directory that was used least recently. The caller
+// must hold the lock.
+func (lc *listingCache) evictOldest() {
+	var oldest string
+	for dir, listing := range lc.dirs {
+		if oldest == "" || listing.used.Before(lc.dirs[oldest].used) {
+			oldest = dir
+		}
+	}
+	delete(lc.dirs, oldest)
+}
+
+func oneOf(s string, values []string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// A breadcrumb is a link to a parent directory of the displayed path.
+type breadcrumb struct {
+	Name string
+	Path string
+}
+
+// breadcrumbs returns the directories leading up to and including the path,
+// starting with the root.
+func breadcrumbs(path string) []breadcrumb {
+	crumbs := []breadcrumb{{Name: "/", Path: "/"}}
+	var current string
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		current += "/" + name
+		crumbs = append(crumbs, breadcrumb{Name: name, Path: current})
+	}
+	return crumbs
+}
+
+// escapePath escapes every segment of a filesystem path for use in a URL.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+var nonWord = regexp.MustCompile(`\W`)
+
+// typeClass turns a MIME type into a valid CSS class name.
+func typeClass(mimeType string) string {
+	return nonWord.ReplaceAllString(mimeType, "-")
+}
+
+// fileIcon returns the Font Awesome classes of the icon shown on the tile of
+// a file with the specified type.
+func fileIcon(mimeType string, isUnlocked bool) string {
+	switch {
+	case mimeType == "directory" && !isUnlocked:
+		return "fa-lock tile-icon-show"
+	case mimeType == "directory":
+		return "fa-folder"
+	case strings.HasPrefix(mimeType, "video"), mimeType == "image/gif":
+		return "fa-play tile-icon-show"
+	case strings.HasPrefix(mimeType, "image"):
+		return "" // Don't show an icon for images.
+	case strings.HasPrefix(mimeType, "audio"):
+		return "fa-music tile-icon-show"
+	case strings.HasPrefix(mimeType, "text"), mimeType == "application/pdf":
+		return "fa-file-text"
+	default:
+		return "fa-file"
+	}
+}
+
+// listIcon returns the Font Awesome class of the icon shown in front of a
+// file with the specified type in the details view.
+func listIcon(mimeType string, isUnlocked bool) string {
+	switch {
+	case mimeType == "directory" && !isUnlocked:
+		return "fa-lock"
+	case mimeType == "directory":
+		return "fa-folder"
+	case strings.HasPrefix(mimeType, "video"):
+		return "fa-file-video-o"
+	case strings.HasPrefix(mimeType, "image"):
+		return "fa-file-image-o"
+	case strings.HasPrefix(mimeType, "audio"):
+		return "fa-file-audio-o"
+	case mimeType == "application/pdf":
+		return "fa-file-pdf-o"
+	case strings.HasPrefix(mimeType, "text"):
+		return "fa-file-text-o"
+	default:
+		return "fa-file-o"
+	}
+}
+
+// humanSize formats a number of bytes using binary prefixes.
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
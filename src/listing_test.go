@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"webfs/src/fs"
+)
+
+func TestParseListingOptionsLimit(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 0},
+		{"?limit=50", 50},
+		{"?limit=1000", maxListingLimit},
+		{"?limit=1001", maxListingLimit},
+		{"?limit=100000", maxListingLimit},
+		{"?limit=0", 0},
+		{"?limit=-5", 0},
+		{"?limit=many", 0},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/view/"+test.query, nil)
+		opts := parseListingOptions(httptest.NewRecorder(), r)
+		if opts.Limit != test.want {
+			t.Errorf("parseListingOptions(%q).Limit = %d, want %d", test.query, opts.Limit, test.want)
+		}
+		if listOpts := opts.listOptions(100); test.want > 0 && listOpts.Limit != test.want {
+			t.Errorf("listOptions() with %q has limit %d, want %d", test.query, listOpts.Limit, test.want)
+		}
+	}
+}
+
+type fakeFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fakeFileInfo) IsDir() bool        { return false }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestListingCache(t *testing.T) {
+	var lc listingCache
+	probes := 0
+	probe := func() (listingFacts, error) {
+		probes++
+		return listingFacts{mimeType: "image/jpeg", hasThumb: true}, nil
+	}
+	epoch := time.Unix(0, 0)
+	file := fs.File{Info: fakeFileInfo{"a.jpg", 10, epoch}, Path: "/dir/a.jpg"}
+
+	steps := []struct {
+		dirModTime time.Time
+		file       fs.File
+		probes     int
+	}{
+		{epoch, file, 1},
+		{epoch, file, 1},
+		// The file was changed.
+		{epoch, fs.File{Info: fakeFileInfo{"a.jpg", 11, epoch}, Path: "/dir/a.jpg"}, 2},
+		{epoch, fs.File{Info: fakeFileInfo{"a.jpg", 11, epoch}, Path: "/dir/a.jpg"}, 2},
+		// A file was added next to it.
+		{epoch.Add(time.Second), fs.File{Info: fakeFileInfo{"a.jpg", 11, epoch}, Path: "/dir/a.jpg"}, 3},
+	}
+	for i, step := range steps {
+		facts, err := lc.facts("/dir", step.dirModTime, step.file, probe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if facts.mimeType != "image/jpeg" || !facts.hasThumb {
+			t.Errorf("step %d: facts = %+v", i, facts)
+		}
+		if probes != step.probes {
+			t.Errorf("step %d: probed %d times, want %d", i, probes, step.probes)
+		}
+	}
+
+	for i := 0; i < 2*maxCachedListings; i++ {
+		lc.facts(fmt.Sprintf("/dir%d", i), epoch, file, probe)
+	}
+	if len(lc.dirs) > maxCachedListings {
+		t.Errorf("%d directories are cached, want at most %d", len(lc.dirs), maxCachedListings)
+	}
+}
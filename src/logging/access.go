@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// AccessLog logs every request handled by the wrapped handler to the "access"
+// component. The client address is determined by clientIP, which may return
+// nil to fall back to the address of the connection.
+func AccessLog(clientIP func(*http.Request) net.IP) func(http.Handler) http.Handler {
+	logger := Component("access")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			defer func() {
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+				remote := r.RemoteAddr
+				if ip := clientIP(r); ip != nil {
+					remote = ip.String()
+				}
+				logger.InfoContext(r.Context(), "Request",
+					"method", r.Method,
+					"uri", r.RequestURI,
+					"proto", r.Proto,
+					"status", status,
+					"bytes", ww.BytesWritten(),
+					"duration", time.Since(start),
+					"remote", remote,
+				)
+			}()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
+
+// RequestID assigns an ID to each request, which is added to messages logged
+// with the request context and is sent back in the X-Request-Id header. IDs
+// passed in the request header are only used if trusted returns true.
+func RequestID(trusted func(*http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withID := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-Id", middleware.GetReqID(r.Context()))
+			next.ServeHTTP(w, r)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !trusted(r) {
+				r.Header.Del("X-Request-Id")
+			}
+			withID.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Package logging provides structured, leveled loggers for the components of
+// webfs. The output format and the level of each component can be changed at
+// any time, including after the loggers have been created.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Config describes the output of all loggers.
+type Config struct {
+	// Either "text" or "json".
+	Format string
+	Level  slog.Level
+	// Overrides the level for specific components.
+	Components map[string]slog.Level
+}
+
+var (
+	output  atomic.Value // Holds a slog.Handler.
+	current atomic.Value // Holds a Config.
+
+	levelsLock sync.Mutex
+	levels     = map[string]*slog.LevelVar{}
+)
+
+func init() {
+	if err := Configure(Config{Format: "text", Level: slog.LevelInfo}, os.Stderr); err != nil {
+		panic(err)
+	}
+}
+
+// ParseLevel parses the name of a level, e.g. "debug" or "warn".
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// Configure applies the configuration to all loggers, which write to w.
+func Configure(config Config, w io.Writer) error {
+	opts := &slog.HandlerOptions{
+		// Levels are checked by the component handlers.
+		Level: slog.Level(-100),
+	}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format: %q", config.Format)
+	}
+	output.Store(handler)
+	current.Store(config)
+
+	levelsLock.Lock()
+	for name, level := range levels {
+		level.Set(config.levelFor(name))
+	}
+	levelsLock.Unlock()
+
+	// Messages logged through the log package, e.g. by libraries, are
+	// attributed to the "main" component.
+	log.SetFlags(0)
+	log.SetOutput(&stdlogWriter{logger: Component("main")})
+	return nil
+}
+
+func (config Config) levelFor(component string) slog.Level {
+	if level, ok := config.Components[component]; ok {
+		return level
+	}
+	return config.Level
+}
+
+func levelVar(component string) *slog.LevelVar {
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+	level, ok := levels[component]
+	if !ok {
+		level = &slog.LevelVar{}
+		if config, ok := current.Load().(Config); ok {
+			level.Set(config.levelFor(component))
+		}
+		levels[component] = level
+	}
+	return level
+}
+
+// Component returns the logger for the named component. Messages are
+// annotated with the component and, if logged with a request context, the ID
+// of the request.
+func Component(name string) *slog.Logger {
+	return slog.New(&componentHandler{
+		component: name,
+		level:     levelVar(name),
+	})
+}
+
+// componentHandler filters messages by the level of its component and passes
+// them on to the current output handler.
+type componentHandler struct {
+	component string
+	level     *slog.LevelVar
+	// Applied to the output handler in order, to record calls to
+	// WithAttrs and WithGroup.
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := output.Load().(slog.Handler)
+	attrs := []slog.Attr{slog.String("component", h.component)}
+	if ctx != nil {
+		if id := middleware.GetReqID(ctx); id != "" {
+			attrs = append(attrs, slog.String("request_id", id))
+		}
+	}
+	handler = handler.WithAttrs(attrs)
+	for _, with := range h.with {
+		handler = with(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.extend(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *componentHandler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	clone := *h
+	clone.with = append(append([]func(slog.Handler) slog.Handler{}, h.with...), with)
+	return &clone
+}
+
+// stdlogWriter logs each line written by the log package as a message.
+type stdlogWriter struct {
+	logger *slog.Logger
+}
+
+func (w *stdlogWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
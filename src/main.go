@@ -1,8 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -11,18 +13,19 @@ import (
 	"image/jpeg"
 	_ "image/png"
 	"io"
-	"log"
-	"mime"
+	iofs "io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/go-chi/chi/middleware"
 	"github.com/nfnt/resize"
 
 	"webfs/src/assets"
@@ -30,22 +33,17 @@ import (
 	"webfs/src/cache/filecache"
 	"webfs/src/cache/memcache"
 	"webfs/src/fs"
+	"webfs/src/logging"
+	"webfs/src/metadata"
+	"webfs/src/metrics"
 	"webfs/src/thumb"
+	"webfs/src/thumb/audio"
 	directoryth "webfs/src/thumb/directory"
 	_ "webfs/src/thumb/image"
 	_ "webfs/src/thumb/vector"
 	_ "webfs/src/thumb/video"
 )
 
-const (
-	PUBLIC = "public"
-)
-
-const (
-	THUMB_WIDTH  = 140
-	THUMB_HEIGHT = 140
-)
-
 var (
 	build       = "<unset>"
 	version     = "<unset>"
@@ -54,129 +52,241 @@ var (
 
 // Global vars are bad, but these are not supposed to be changed.
 var (
-	startTime     = time.Now()
-	pageTemplates = map[string]*template.Template{}
-	staticAssets  = genStaticAssets()
+	startTime = time.Now()
+)
+
+var (
+	mainLogger   = logging.Component("main")
+	serverLogger = logging.Component("server")
+	httpLogger   = logging.Component("http")
+	authLogger   = logging.Component("auth")
+	auditLogger  = logging.Component("audit")
+	configLogger = logging.Component("config")
 )
 
 type contextKey int
 
 const (
 	pathContextKey = iota + 1
+	operationContextKey
+	auditContextKey
+	cspNonceContextKey
+	csrfContextKey
+	unixSocketContextKey
 )
 
-type AssetServeHandler string
+func main() {
+	mainLogger.Info("Starting webfs", "version", version, "build", build)
 
-func (name AssetServeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(string(name))))
-	modTime := startTime
-	if build == "debug" {
-		modTime = time.Now()
-	}
-	http.ServeContent(w, r, string(name), modTime, bytes.NewReader(assets.MustAsset(string(name))))
-}
+	configFile := flag.String("config", "", "A TOML file to load the configuration from, flags that are set explicitly take precedence")
+	flagConfig := DefaultConfig()
+	flagConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 
-func main() {
-	log.Printf("Version: %v (%v)\n", version, build)
-
-	listenAddress := flag.String("listen", "localhost:8080", "The HTTP root of a Piwik installation, must not end with a slash")
-	urlRoot := flag.String("urlroot", "", "The HTTP root, must not end with a slash")
-	piwikRoot := flag.String("piwik-root", "", "The HTTP root of a Piwik installation, must not end with a slash")
-	piwikSiteID := flag.Int("piwik-site", 0, "The Piwik Site ID")
-	pregenThumbs := flag.Bool("pregen-thumbs", false, "Generate thumbnails for every file in all configured filesystems on startup")
-	defaultCacheDir := filepath.Join(os.TempDir(), fmt.Sprintf("webfs-%d", os.Getuid()))
-	cacheDir := flag.String("cache-dir", defaultCacheDir, "The directory to store generated thumbnails. If empty, all files are kept in memory")
-	mountPath := flag.String("mount", ".", "The root directory to expose")
-	var noPasswd *bool
-	if build == "debug" {
-		noPasswd = flag.Bool("nopasswd", false, "Globally disable passord protection (debug builds only)")
-	} else {
-		noPasswd = new(bool)
+	loadConfig := func() (*Config, error) {
+		return LoadConfig(*configFile, flag.CommandLine, &flagConfig)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	if err := configureLogging(config.Log); err != nil {
+		fatal(err)
 	}
-	flag.Parse()
 
-	if *urlRoot == "" {
-		*urlRoot = fmt.Sprintf("http://%s", *listenAddress)
+	trustedProxies, err := ParseTrustedProxies(strings.Join(config.TrustedProxies, ","))
+	if err != nil {
+		fatal(err)
 	}
 
 	var thumbCache cache.Cache
 	var sessionBaseDir string
-	if *cacheDir != "" {
-		d, err := resolveHome(filepath.Join(*cacheDir, "thumbs"))
+	var readinessChecks []readinessCheck
+	if config.CacheDir != "" {
+		d, err := resolveHome(filepath.Join(config.CacheDir, "thumbs"))
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
+		readinessChecks = append(readinessChecks, readinessCheck{"cache", checkWritableDir(d)})
 		cache, err := filecache.NewCache(d, 0)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		thumbCache = cache
-		sessionBaseDir = *cacheDir
+		sessionBaseDir = config.CacheDir
+
+		metadataFile, err := resolveHome(filepath.Join(config.CacheDir, "metadata.json"))
+		if err != nil {
+			fatal(err)
+		}
+		// Which thumber accepts a file depends on the thumbers that are
+		// available.
+		metadataVersion := version + " " + strings.Join(thumb.Thumbers(), ",")
+		store, err := metadata.Open(metadataFile, metadataVersion)
+		if err != nil {
+			fatal(err)
+		}
+		metadata.SetShared(store)
 	} else {
 		thumbCache = memcache.NewCache()
 		sessionBaseDir = os.TempDir()
 	}
 
-	mount, err := resolveHome(strings.TrimSuffix(*mountPath, "/"))
+	sessionDir, err := resolveHome(filepath.Join(sessionBaseDir, "sessions"))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	tokens, err := NewTokenStore(filepath.Join(sessionDir, "tokens.json"))
+	if err != nil {
+		fatal(err)
+	}
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "token" {
+			fatal(fmt.Errorf("unknown command: %q", flag.Arg(0)))
+		}
+		if err := tokenCommand(tokens, flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	mount, err := resolveHome(strings.TrimSuffix(config.Mount, "/"))
+	if err != nil {
+		fatal(err)
 	}
 	filesystem, err := fs.NewFilesystem(mount, thumbCache)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	readinessChecks = append(readinessChecks, readinessCheck{"mount", checkReadableDir(mount)})
 
 	var authenticator Authenticator
-	if *noPasswd {
+	if config.Auth.NoPasswd {
 		authenticator = NilAuthenticator{Filesystem: filesystem}
-		log.Println("Password authentication disabled")
+		authLogger.Warn("Password authentication disabled")
 	} else {
-		d, err := resolveHome(filepath.Join(sessionBaseDir, "sessions"))
-		if err != nil {
-			log.Fatal(err)
-		}
-		auth, err := NewBasicAuthenticator(filesystem, d)
+		auth, err := NewBasicAuthenticator(filesystem, sessionDir, trustedProxies)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		authenticator = auth
+		readinessChecks = append(readinessChecks, readinessCheck{"sessions", checkWritableDir(sessionDir)})
 	}
+	authenticator = NewTokenAuthenticator(authenticator, filesystem, tokens)
 
-	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-
-	for _, file := range assets.AssetNames() {
-		if !strings.HasPrefix(file, PUBLIC) {
-			continue
+	var auditLog *AuditLog
+	var auditSinks []io.Writer
+	if config.Audit.File != "" {
+		f, err := resolveHome(config.Audit.File)
+		if err != nil {
+			fatal(err)
+		}
+		sink, err := NewRotatingFile(f, config.Audit.MaxSize<<20, config.Audit.Backups)
+		if err != nil {
+			fatal(err)
 		}
-		urlPath := strings.TrimPrefix(file, PUBLIC)
-		r.Mount(urlPath, AssetServeHandler(file))
+		auditSinks = append(auditSinks, sink)
+	}
+	if config.Audit.Syslog {
+		sink, err := NewSyslogSink()
+		if err != nil {
+			fatal(err)
+		}
+		auditSinks = append(auditSinks, sink)
+	}
+	if len(auditSinks) > 0 {
+		auditLog = NewAuditLog(trustedProxies, auditSinks...)
 	}
 
-	web := Web{
-		fs:            filesystem,
-		thumbCache:    thumbCache,
-		authenticator: authenticator,
-		urlRoot:       *urlRoot,
-		piwikRoot:     *piwikRoot,
-		piwikSiteID:   *piwikSiteID,
+	assetsDir, err := resolveHome(config.AssetsDir)
+	if err != nil {
+		fatal(err)
+	}
+	siteAssets, err := assets.Open(assetsDir)
+	if err != nil {
+		fatal(err)
+	}
+	templates, err := parseTemplates(siteAssets)
+	if err != nil {
+		fatal(err)
 	}
 
-	r.Group(func(r chi.Router) {
-		r.Use(fsPathCtx)
-		r.Get("/view/*", web.view)
-		r.Get("/thumb/*", web.thumb)
-		r.Get("/get/*", web.download)
-		r.Get("/download/*", web.downloadZip)
+	web := &Web{
+		fs:             filesystem,
+		assets:         siteAssets,
+		templates:      templates,
+		thumbCache:     thumbCache,
+		authenticator:  authenticator,
+		trustedProxies: trustedProxies,
+	}
+	web.setConfig(config)
+	go reloadOnSIGHUP(loadConfig, web.config, func(config *Config) {
+		web.setConfig(config)
+		if err := configureLogging(config.Log); err != nil {
+			configLogger.Error("Could not configure logging", "err", err)
+		}
 	})
 
-	if *pregenThumbs {
-		go filesystem.PregenerateThumbnails(THUMB_WIDTH, THUMB_HEIGHT)
+	r := chi.NewRouter()
+	r.Use(logging.RequestID(trustedProxies.IsTrusted))
+	r.Use(logging.AccessLog(trustedProxies.ClientIP))
+	if config.Metrics.Enabled {
+		metrics.RegisterCache("thumbs", thumbCache)
+		metrics.RegisterCache("metadata", metadata.Shared())
+		r.Use(metrics.Middleware)
+	}
+	r.Use(securityHeaders(web.config))
+	r.Use(csrfProtect)
+
+	// The health checks are not mounted under the base path, they are
+	// meant to be queried directly rather than through a proxy.
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz(readinessChecks))
+
+	routes := func(r chi.Router) {
+		for _, urlPath := range web.assets.Paths() {
+			r.Handle(urlPath, web.assets.Handler(urlPath))
+		}
+		if config.Metrics.Enabled && config.Metrics.Addr == "" {
+			r.With(web.requireAdmin).Handle("/metrics", metrics.Handler())
+		}
+		r.With(web.requireAdmin).Get("/admin", web.adminStatus)
+
+		r.Group(func(r chi.Router) {
+			r.Use(fsPathCtx)
+			r.With(operationCtx(OpList), auditLog.Middleware(ActionView)).Get("/view/*", web.view)
+			r.With(operationCtx(OpList), auditLog.Middleware(ActionThumb)).Get("/thumb/*", web.thumb)
+			r.With(operationCtx(OpList), auditLog.Middleware(ActionTimeline)).Get("/timeline/*", web.timeline)
+			r.With(operationCtx(OpList), auditLog.Middleware(ActionMap)).Get("/map/*", web.mapView)
+			r.With(operationCtx(OpList), auditLog.Middleware(ActionPlaylist)).Get("/playlist/*", web.playlist)
+			r.With(operationCtx(OpGet), auditLog.Middleware(ActionGet)).Get("/get/*", web.download)
+			r.With(operationCtx(OpGet), auditLog.Middleware(ActionPreview)).Get("/preview/*", web.preview)
+			r.With(operationCtx(OpDownload), auditLog.Middleware(ActionZip)).Get("/download/*", web.downloadZip)
+			r.With(auditLog.Middleware(ActionUnlock)).Post("/totp/*", web.verifySecondFactor)
+		})
+	}
+	if config.BasePath != "" {
+		r.Route(config.BasePath, routes)
+	} else {
+		routes(r)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		metadata.Shared().SaveEvery(ctx, time.Minute)
+	}()
+	if config.Thumbnail.Pregenerate {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			filesystem.PregenerateThumbnails(ctx, config.Thumbnail.Width, config.Thumbnail.Height)
+		}()
 	}
 
-	log.Printf("Now accepting HTTP connections on %v", *listenAddress)
 	server := &http.Server{
-		Addr:           *listenAddress,
 		Handler:        r,
 		MaxHeaderBytes: 1 << 20,
 		ReadTimeout:    10 * time.Second,
@@ -184,32 +294,133 @@ func main() {
 		// get aborted after the usual 10 seconds. The issue can not be fixed
 		// right now due to limitations of the Go HTTP server.
 		WriteTimeout: 2 * time.Hour,
+		ConnContext:  unixSocketConnContext,
 	}
-	log.Fatal(server.ListenAndServe())
-}
-
-func genStaticAssets() map[string][]string {
-	static := map[string][]string{
-		"js":  {},
-		"css": {},
+	var redirectHandler http.Handler
+	if config.TLS.Enabled() {
+		_, port, _ := net.SplitHostPort(config.tcpListen())
+		redirectHandler = redirectHTTPS(port)
 	}
-	for _, file := range assets.AssetNames() {
-		if !strings.HasPrefix(file, PUBLIC) {
-			continue
+	if config.TLS.Cert != "" {
+		certFile, err := resolveHome(config.TLS.Cert)
+		if err != nil {
+			fatal(err)
 		}
-		urlPath := strings.TrimPrefix(file, PUBLIC)
+		keyFile, err := resolveHome(config.TLS.Key)
+		if err != nil {
+			fatal(err)
+		}
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			fatal(err)
+		}
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	} else if len(config.TLS.ACME.Domains) > 0 {
+		acmeDir, err := resolveHome(filepath.Join(sessionBaseDir, "acme"))
+		if err != nil {
+			fatal(err)
+		}
+		manager, err := newACMEManager(config.TLS.ACME, acmeDir)
+		if err != nil {
+			fatal(err)
+		}
+		server.TLSConfig = manager.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+		// Answers HTTP-01 challenges, the TLS-ALPN-01 challenge is
+		// handled by the TLS listener.
+		redirectHandler = manager.HTTPHandler(redirectHandler)
+	}
 
-		switch filepath.Ext(file) {
-		case ".css":
-			static["css"] = append(static["css"], urlPath)
-		case ".js":
-			static["js"] = append(static["js"], urlPath)
+	mainGroup := listenerGroup{name: "main", server: server}
+	redirectGroup := listenerGroup{
+		name: "redirect",
+		server: &http.Server{
+			Handler:        redirectHandler,
+			MaxHeaderBytes: 1 << 20,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+		},
+	}
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", metrics.Handler())
+	metricsGroup := listenerGroup{
+		name: "metrics",
+		server: &http.Server{
+			Handler:        metricsMux,
+			MaxHeaderBytes: 1 << 20,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+		},
+	}
+	inherited, err := inheritedListeners()
+	if err != nil {
+		fatal(err)
+	}
+	for name, listeners := range inherited {
+		switch name {
+		case redirectGroup.name:
+			redirectGroup.listeners = append(redirectGroup.listeners, listeners...)
+		case metricsGroup.name:
+			metricsGroup.listeners = append(metricsGroup.listeners, listeners...)
+		default:
+			mainGroup.listeners = append(mainGroup.listeners, listeners...)
 		}
 	}
-	for _, a := range static {
-		sort.Strings(a)
+	if len(inherited) == 0 {
+		for _, addr := range config.Listen {
+			l, err := listen(addr, config.socketMode(), config.SocketGroup)
+			if err != nil {
+				fatal(err)
+			}
+			mainGroup.listeners = append(mainGroup.listeners, l)
+		}
+		if config.TLS.Redirect != "" {
+			l, err := listen(config.TLS.Redirect, config.socketMode(), config.SocketGroup)
+			if err != nil {
+				fatal(err)
+			}
+			redirectGroup.listeners = append(redirectGroup.listeners, l)
+		}
+		if config.Metrics.Addr != "" {
+			l, err := listen(config.Metrics.Addr, config.socketMode(), config.SocketGroup)
+			if err != nil {
+				fatal(err)
+			}
+			metricsGroup.listeners = append(metricsGroup.listeners, l)
+		}
+	}
+	groups := []listenerGroup{mainGroup}
+	if redirectHandler != nil && len(redirectGroup.listeners) > 0 {
+		groups = append(groups, redirectGroup)
+	}
+	if config.Metrics.Enabled && len(metricsGroup.listeners) > 0 {
+		groups = append(groups, metricsGroup)
+	}
+
+	if err := serve(groups, func() time.Duration { return web.config().ShutdownTimeout }); err != nil {
+		fatal(err)
+	}
+
+	cancel()
+	background.Wait()
+	if err := thumbCache.Close(); err != nil {
+		mainLogger.Error("Could not close thumbnail cache", "err", err)
 	}
-	return static
+	if auditLog != nil {
+		if err := auditLog.Close(); err != nil {
+			mainLogger.Error("Could not close audit log", "err", err)
+		}
+	}
+	mainLogger.Info("Shutdown complete")
+}
+
+// fatal logs the error and exits.
+func fatal(err error) {
+	mainLogger.Error(err.Error())
+	os.Exit(1)
 }
 
 func fsPathCtx(next http.Handler) http.Handler {
@@ -229,78 +440,46 @@ type Web struct {
 	fs            *fs.Filesystem
 	authenticator Authenticator
 	thumbCache    cache.Cache
+	assets        *assets.Assets
+
+	templates map[string]*template.Template
+	listings  listingCache
+
+	trustedProxies TrustedProxies
+
+	// Holds a *Config which may be replaced at runtime.
+	cfg atomic.Value
+}
+
+func (web *Web) config() *Config {
+	return web.cfg.Load().(*Config)
+}
 
-	urlRoot     string
-	piwikRoot   string
-	piwikSiteID int
+func (web *Web) setConfig(config *Config) {
+	web.cfg.Store(config)
 }
 
 func (web *Web) view(w http.ResponseWriter, r *http.Request) {
 	renderFile := func(path string) {
-		fileI, err := web.fs.View(path, web.authenticator.FSAuthenticator(r))
+		info, err := web.fs.FileInfo(path, web.authenticator.FSAuthenticator(r))
 		if err != nil {
-			log.Printf("Could not view %q: %v", path, err)
+			httpLogger.ErrorContext(r.Context(), "Could not view file", "path", path, "err", err)
 			return
 		}
-
-		if files, ok := fileI.([]fs.File); ok {
-			tmplFiles := make([]map[string]interface{}, len(files))
-			for i, child := range files {
-				err := web.authenticator.FSAuthenticator(r).IsAuthenticated(child.Path)
-				if err != nil && err != fs.ErrNeedAuthentication {
-					log.Printf("Could not check whether %q is authenticated: %v", child.Name(), err)
-				}
-				isUnlocked := err == nil
-
-				tmplFiles[i] = map[string]interface{}{
-					"name": child.Name(),
-					"path": child.RelPath,
-					"type": func() string {
-						if child.Info.IsDir() {
-							return "directory"
-						}
-						mime, err := thumb.MimeType(child.Path)
-						if err != nil {
-							panic(err)
-						}
-						return mime
-					}(),
-					"hasThumb": func() bool {
-						if !isUnlocked {
-							ok, _ := directoryth.HasIconThumb(child.Path)
-							return ok
-						}
-						th, _ := thumb.FindThumber(child.Path)
-						return th != nil
-					}(),
-					"hasPassword": func() bool {
-						hasPassword, err := web.authenticator.HasPassword(child.Path)
-						if err != nil {
-							log.Printf("Could not check whether %q is protected: %v", path, err)
-							return true
-						}
-						return hasPassword
-					}(),
-					"isUnlocked": isUnlocked,
-				}
-			}
-
-			args := web.baseTeplateArgs()
-			args["files"] = tmplFiles
-			args["fs"] = web.fs
-			args["path"] = path
-			args["title"] = filepath.Base(path)
-			if err := getPageTemplate("main.html").Execute(w, args); err != nil {
-				panic(err)
-			}
+		if info.IsDir() {
+			web.renderListing(w, r, path)
 			return
 		}
 
-		file := fileI.(fs.File)
+		file := fs.File{
+			Info:    info,
+			Path:    web.fs.RealPath(path),
+			RelPath: path,
+		}
 
 		// Scale down the image to reduce transfer time to the client.
 		if ok, err := thumb.AcceptMimes(file.Path, "image/jpeg", "image/png"); err != nil {
-			log.Println(err)
+			httpLogger.ErrorContext(r.Context(), "Could not determine file type", "path", file.RelPath, "err", err)
 			return
 		} else if ok {
 			const WIDTH, HEIGHT = 1366, 768
@@ -319,7 +498,7 @@ func (web *Web) view(w http.ResponseWriter, r *http.Request) {
 			})
 
 			if err != nil {
-				log.Println(err)
+				httpLogger.ErrorContext(r.Context(), "Could not scale image", "path", file.RelPath, "err", err)
 				http.NotFound(w, r)
 				return
 			}
@@ -332,21 +511,38 @@ func (web *Web) view(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		mimeType, err := thumb.MimeType(file.Path)
+		if err != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not determine file type", "path", file.RelPath, "err", err)
+			return
+		}
+		if isMarkdown(mimeType) && r.URL.Query().Get("fmt") == "text/html" {
+			web.renderMarkdownFile(w, r, file)
+			return
+		}
+		userContentHeaders(w, file.Path, mimeType, false)
 		http.ServeFile(w, r, file.Path)
 	}
 
 	path := r.Context().Value(pathContextKey).(string)
 
 	if ok, err := web.authenticator.Authenticate(web.fs.RealPath(path), w, r); err != nil {
-		log.Println(err)
+		if sf, isSF := err.(*SecondFactorRequired); isSF {
+			web.renderSecondFactor(w, r, path, sf)
+			return
+		}
+		authLogger.ErrorContext(r.Context(), "Could not authenticate", "path", path, "err", err)
 		return
 	} else if !ok {
 		parent, err := web.fs.FirstAccessibleParent(path, web.authenticator.FSAuthenticator(r))
 		if err == fs.ErrNeedAuthentication {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
+		} else if err == fs.ErrAccessDenied {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
 		} else if err != nil {
-			log.Printf("Could not get first accessible parent of %q: %v", path, err)
+			httpLogger.ErrorContext(r.Context(), "Could not get first accessible parent", "path", path, "err", err)
 			return
 		}
 		renderFile(parent)
@@ -356,21 +552,201 @@ func (web *Web) view(w http.ResponseWriter, r *http.Request) {
 	renderFile(path)
 }
 
+// renderListing renders a page of the directory at path. The type of the files
+// and whether they have a thumbnail are only determined for the files on the
+// page and cached per directory.
+func (web *Web) renderListing(w http.ResponseWriter, r *http.Request, path string) {
+	auth := web.authenticator.FSAuthenticator(r)
+	listing := parseListingOptions(w, r)
+	asJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+	page, err := web.fs.List(path, auth, listing.listOptions(web.config().UI.PageSize))
+	if err == fs.ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not list directory", "path", path, "err", err)
+		return
+	}
+
+	dirFilename := web.fs.RealPath(path)
+	dirInfo, err := os.Stat(dirFilename)
+	if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not list directory", "path", path, "err", err)
+		return
+	}
+
+	// Files are protected per directory, so whether they are unlocked and
+	// protected by a password is only checked once for the directory and
+	// once for every subdirectory on the page.
+	type dirAuth struct{ unlocked, hasPassword bool }
+	dirAuths := map[string]dirAuth{}
+	authOf := func(child fs.File) dirAuth {
+		dir := child.Path
+		if !child.Info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		if a, ok := dirAuths[dir]; ok {
+			return a
+		}
+		err := auth.IsAuthenticated(dir)
+		if err != nil && err != fs.ErrNeedAuthentication && err != fs.ErrAccessDenied {
+			httpLogger.ErrorContext(r.Context(), "Could not check whether file is authenticated", "path", child.RelPath, "err", err)
+		}
+		hasPassword, perr := web.authenticator.HasPassword(dir)
+		if perr != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not check whether file is protected", "path", child.RelPath, "err", perr)
+			hasPassword = true
+		}
+		a := dirAuth{unlocked: err == nil, hasPassword: hasPassword}
+		dirAuths[dir] = a
+		return a
+	}
+
+	tmplFiles := make([]map[string]interface{}, len(page.Files))
+	hasAudio := false
+	for i, child := range page.Files {
+		a := authOf(child)
+		facts, err := web.listings.facts(dirFilename, dirInfo.ModTime(), child, func() (listingFacts, error) {
+			if child.Info.IsDir() {
+				th, err := thumb.FindThumber(child.Path)
+				return listingFacts{mimeType: "directory", hasThumb: th != nil}, err
+			}
+			mimeType, err := thumb.MimeType(child.Path)
+			if err != nil {
+				return listingFacts{mimeType: "application/octet-stream"}, err
+			}
+			th, err := thumb.FindThumber(child.Path)
+			facts := listingFacts{mimeType: mimeType, hasThumb: th != nil}
+			if err != nil || !strings.HasPrefix(mimeType, "audio/") {
+				return facts, err
+			}
+			tags, err := audio.ReadTags(child.Path)
+			if err != nil {
+				return facts, err
+			}
+			facts.tags = &tags
+			return facts, nil
+		})
+		if err != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not inspect file", "path", child.RelPath, "err", err)
+		}
+		hasThumb := facts.hasThumb
+		if !a.unlocked {
+			hasThumb, _ = directoryth.HasIconThumb(child.Path)
+		}
+
+		tmplFiles[i] = map[string]interface{}{
+			"name":        child.Name(),
+			"path":        child.RelPath,
+			"type":        facts.mimeType,
+			"hasThumb":    hasThumb,
+			"hasPassword": a.hasPassword,
+			"isUnlocked":  a.unlocked,
+			"size":        child.Info.Size(),
+			"modTime":     child.Info.ModTime(),
+		}
+		if strings.HasPrefix(facts.mimeType, "audio/") {
+			hasAudio = true
+			if facts.tags != nil {
+				tmplFiles[i]["tags"] = *facts.tags
+			}
+		}
+	}
+	var next string
+	if page.Next != "" {
+		next = listing.Next(page.Next)
+	}
+
+	if asJSON {
+		if next != "" {
+			w.Header().Set("Link", "<"+next+">; rel=\"next\"")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tmplFiles); err != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not encode listing", "path", path, "err", err)
+		}
+		return
+	}
+
+	// The README is only shown on the first page, the following pages are
+	// appended to it.
+	var readme *dirReadme
+	if web.config().UI.Readme != "hidden" && listing.Cursor == "" {
+		if readme, err = web.readme(r, path); err != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not read README", "path", path, "err", err)
+		}
+	}
+
+	args := web.baseTeplateArgs(r)
+	args["files"] = tmplFiles
+	args["readme"] = readme
+	args["readmePosition"] = web.config().UI.Readme
+	args["hasAudio"] = hasAudio
+	args["offset"] = page.Offset
+	args["total"] = page.Total
+	args["next"] = next
+	args["fs"] = web.fs
+	args["path"] = path
+	args["breadcrumbs"] = breadcrumbs(path)
+	args["listing"] = listing
+	args["listingTypes"] = listingTypes
+	args["slideshowInterval"] = web.config().UI.SlideshowInterval.Milliseconds()
+	args["title"] = filepath.Base(path)
+	if err := web.pageTemplate("main.html").Execute(w, args); err != nil {
+		panic(err)
+	}
+}
+
+func (web *Web) renderSecondFactor(w http.ResponseWriter, r *http.Request, path string, sf *SecondFactorRequired) {
+	args := web.baseTeplateArgs(r)
+	args["path"] = path
+	args["title"] = filepath.Base(path)
+	args["user"] = sf.User
+	args["enrollment"] = sf.Enrollment
+	args["invalid"] = r.URL.Query().Get("totp") == "invalid"
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := web.pageTemplate("totp.html").Execute(w, args); err != nil {
+		panic(err)
+	}
+}
+
+func (web *Web) verifySecondFactor(w http.ResponseWriter, r *http.Request) {
+	path := r.Context().Value(pathContextKey).(string)
+
+	ok, err := web.authenticator.VerifySecondFactor(web.fs.RealPath(path), r.PostFormValue("code"), w, r)
+	if err != nil {
+		authLogger.ErrorContext(r.Context(), "Could not verify second factor", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	target := web.urlRoot(r) + "/view" + path
+	if !ok {
+		target += "?totp=invalid"
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
 func (web *Web) thumb(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimSuffix(r.Context().Value(pathContextKey).(string), ".jpg")
 
-	img, mime, modTime, err := web.fs.Thumbnail(path, THUMB_WIDTH, THUMB_HEIGHT, web.authenticator.FSAuthenticator(r))
+	thumbConfig := web.config().Thumbnail
+	img, mime, modTime, err := web.fs.Thumbnail(r.Context(), path, thumbConfig.Width, thumbConfig.Height, web.authenticator.FSAuthenticator(r))
 	if err == fs.ErrFileDoesNotExist {
 		http.NotFound(w, r)
 		return
 	} else if err == fs.ErrNeedAuthentication {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
+	} else if err == fs.ErrAccessDenied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
 	} else if err == fs.ErrNoThumbnail {
 		http.NotFound(w, r)
 		return
 	} else if err != nil {
-		log.Printf("Could not get thumbnail for %q: %v", path, err)
+		httpLogger.ErrorContext(r.Context(), "Could not get thumbnail", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	defer img.Close()
@@ -388,11 +764,20 @@ func (web *Web) download(w http.ResponseWriter, r *http.Request) {
 	} else if err == fs.ErrNeedAuthentication {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
+	} else if err == fs.ErrAccessDenied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
 	} else if err != nil {
-		log.Printf("Could not get file path for %q: %v", path, err)
+		httpLogger.ErrorContext(r.Context(), "Could not get file path", "path", path, "err", err)
 		return
 	}
 
+	mimeType, err := thumb.MimeType(filepath)
+	if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not determine file type", "path", path, "err", err)
+		return
+	}
+	userContentHeaders(w, filepath, mimeType, true)
 	http.ServeFile(w, r, filepath)
 }
 
@@ -402,6 +787,8 @@ func (web *Web) downloadZip(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", "attachment; filename=\"webfs.zip\"")
 
+	metrics.ActiveZips.Inc()
+	defer metrics.ActiveZips.Dec()
 	err := web.fs.Zip(path, w, web.authenticator.FSAuthenticator(r))
 	if err == fs.ErrFileDoesNotExist {
 		http.NotFound(w, r)
@@ -409,39 +796,139 @@ func (web *Web) downloadZip(w http.ResponseWriter, r *http.Request) {
 	} else if err == fs.ErrNeedAuthentication {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
+	} else if err == fs.ErrAccessDenied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
 	} else if err != nil {
-		log.Printf("Could not zip %q: %v", path, err)
+		httpLogger.ErrorContext(r.Context(), "Could not zip", "path", path, "err", err)
 		return
 	}
 }
 
-func (web *Web) baseTeplateArgs() map[string]interface{} {
+// urlRoot returns the absolute URL of the root of webfs as seen by the client
+// that made the request. The configured urlroot takes precedence, otherwise
+// it is derived from the request and the headers set by trusted proxies.
+func (web *Web) urlRoot(r *http.Request) string {
+	config := web.config()
+	if config.URLRoot != "" {
+		return config.URLRoot
+	}
+	return web.trustedProxies.ExternalRoot(r) + config.BasePath
+}
+
+func (web *Web) baseTeplateArgs(r *http.Request) map[string]interface{} {
+	config := web.config()
 	return map[string]interface{}{
+		"cspNonce":  cspNonce(r),
+		"csrfToken": csrfToken(r),
+
 		"build":       build,
 		"version":     version,
 		"versionDate": versionDate,
 
-		"urlroot": web.urlRoot,
-		"assets":  staticAssets,
-		"time":    time.Now(),
+		"urlroot": web.urlRoot(r),
+		"assets": map[string][]string{
+			"css": web.assets.WithExt(".css"),
+			"js":  web.assets.WithExt(".js"),
+		},
+		"time": time.Now(),
+
+		"site": web.siteArgs(r),
 
-		"piwik":       web.piwikRoot != "" && web.piwikSiteID != 0,
-		"piwikRoot":   web.piwikRoot,
-		"piwikSiteID": web.piwikSiteID,
+		"piwik":       config.UI.PiwikRoot != "" && config.UI.PiwikSiteID != 0,
+		"piwikRoot":   config.UI.PiwikRoot,
+		"piwikSiteID": config.UI.PiwikSiteID,
 	}
 }
 
-func getPageTemplate(name string) *template.Template {
-	if build == "debug" {
-		return template.Must(template.New(name).Parse(string(assets.MustAsset(name))))
+// SiteArgs are the site-wide settings passed to every page as .site.
+type SiteArgs struct {
+	Title  string
+	Logo   string
+	Footer template.HTML
+	// Declarations of the configured colors for a style element.
+	Style template.CSS
+}
+
+func (web *Web) siteArgs(r *http.Request) SiteArgs {
+	ui := web.config().UI
+	site := SiteArgs{
+		Title:  ui.Title,
+		Footer: template.HTML(ui.Footer),
+	}
+	if ui.Logo != "" {
+		site.Logo = web.urlRoot(r) + web.assets.URL(ui.Logo)
+	}
+	var decls []string
+	for name, color := range ui.Colors.properties() {
+		if color != "" {
+			decls = append(decls, name+": "+color+";")
+		}
+	}
+	if len(decls) > 0 {
+		sort.Strings(decls)
+		site.Style = template.CSS(":root { " + strings.Join(decls, " ") + " }")
+	}
+	return site
+}
+
+// parseTemplates parses every page template of the assets along with the
+// partials it may include, so broken overrides are reported on startup.
+func parseTemplates(siteAssets *assets.Assets) (map[string]*template.Template, error) {
+	names, err := iofs.Glob(siteAssets.FS(), "*.html")
+	if err != nil {
+		return nil, err
+	}
+	templates := map[string]*template.Template{}
+	for _, name := range names {
+		tmpl, err := parsePageTemplate(siteAssets, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := escapeTemplate(tmpl); err != nil {
+			return nil, err
+		}
+		templates[name] = tmpl
 	}
+	return templates, nil
+}
 
-	if tmpl, ok := pageTemplates[name]; ok {
-		return tmpl
+func parsePageTemplate(siteAssets *assets.Assets, name string) (*template.Template, error) {
+	source, err := siteAssets.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).ParseFS(siteAssets.FS(), "partials/*.html")
+	if err != nil {
+		return nil, err
+	}
+	// The page is parsed last so it can redefine the blocks of the partials.
+	return tmpl.Parse(string(source))
+}
+
+// escapeTemplate reports the errors in a template that html/template only
+// finds when it escapes the template on its first execution, such as actions
+// in unquoted attributes. Other errors depend on the data and are expected
+// when it is executed without any.
+func escapeTemplate(tmpl *template.Template) error {
+	var escapeErr *template.Error
+	if err := tmpl.Execute(io.Discard, nil); errors.As(err, &escapeErr) {
+		return err
+	}
+	return nil
+}
+
+// pageTemplate returns the named page template along with the partials it
+// may include. Debug builds parse the template again on every call.
+func (web *Web) pageTemplate(name string) *template.Template {
+	if build == "debug" {
+		return template.Must(parsePageTemplate(web.assets, name))
+	}
+	tmpl, ok := web.templates[name]
+	if !ok {
+		panic(fmt.Sprintf("no such template: %s", name))
 	}
-	pageTemplates[name] = template.Must(template.New(name).
-		Parse(string(assets.MustAsset(name))))
-	return pageTemplates[name]
+	return tmpl
 }
 
 func resolveHome(p string) (string, error) {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestEscapeTemplate(t *testing.T) {
+	tests := []struct {
+		source string
+		ok     bool
+	}{
+		{`<p title="{{ .title }}">{{ humanSize .size }}</p>`, true},
+		{`{{ range .files }}<a href="/view/{{ escapePath .path }}">{{ .name }}</a>{{ end }}`, true},
+		// Branches that end in different contexts can not be escaped.
+		{`<a {{ if .x }}href="{{ end }}">`, false},
+		{`<script>var x = "{{ .x }}</script>`, false},
+	}
+	for _, test := range tests {
+		tmpl, err := template.New("page.html").Funcs(templateFuncs).Parse(test.source)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", test.source, err)
+		}
+		if err := escapeTemplate(tmpl); (err == nil) != test.ok {
+			t.Errorf("escapeTemplate(%q) = %v, want ok = %v", test.source, err, test.ok)
+		}
+	}
+}
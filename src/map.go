@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"webfs/src/fs"
+)
+
+func (web *Web) mapView(w http.ResponseWriter, r *http.Request) {
+	path := r.Context().Value(pathContextKey).(string)
+
+	photos, err := web.fs.Geotagged(r.Context(), path, web.authenticator.FSAuthenticator(r))
+	if err == fs.ErrFileDoesNotExist || err == fs.ErrNotDirectory {
+		http.NotFound(w, r)
+		return
+	} else if err == fs.ErrNeedAuthentication {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	} else if err == fs.ErrAccessDenied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	} else if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not find geotagged photos", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	files := make([]map[string]interface{}, len(photos))
+	for i, photo := range photos {
+		files[i] = photoFile(photo)
+		files[i]["lat"] = photo.Location.Lat
+		files[i]["long"] = photo.Location.Long
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(files); err != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not encode geotagged photos", "path", path, "err", err)
+		}
+		return
+	}
+
+	config := web.config()
+	args := web.baseTeplateArgs(r)
+	args["files"] = files
+	args["path"] = path
+	args["breadcrumbs"] = breadcrumbs(path)
+	args["tileURL"] = config.Map.TileURL
+	args["attribution"] = config.Map.Attribution
+	args["maxZoom"] = config.Map.MaxZoom
+	args["slideshowInterval"] = config.UI.SlideshowInterval.Milliseconds()
+	args["title"] = "Map of " + filepath.Base(path)
+	if err := web.pageTemplate("map.html").Execute(w, args); err != nil {
+		panic(err)
+	}
+}
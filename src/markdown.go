@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+
+	"webfs/src/fs"
+)
+
+// Only the start of larger documents is rendered.
+const maxMarkdownSize = 1 << 20
+
+// The names of the files that are shown as the README of a directory, in
+// order of preference.
+var readmeNames = []string{"README.md", "readme.md", "README.txt", "readme.txt", "README"}
+
+func init() {
+	// Not every MIME database knows markdown, which must be recognized to
+	// be rendered.
+	for _, ext := range []string{".md", ".markdown"} {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, "text/markdown; charset=utf-8")
+		}
+	}
+}
+
+func isMarkdown(mimeType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	return mediaType == "text/markdown"
+}
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	// Raw HTML is kept, it is sanitized after rendering.
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+var markdownPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w-]+$`)).OnElements("code")
+	return policy
+}()
+
+// renderMarkdown renders a markdown document to sanitized HTML. Relative
+// links and images are resolved against base, the URL of the directory of
+// the document ending in a slash.
+func renderMarkdown(source []byte, base string) (template.HTML, error) {
+	doc := markdown.Parser().Parse(text.NewReader(source))
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			n.Destination = resolveRelative(base, n.Destination)
+		case *ast.Image:
+			n.Destination = resolveRelative(base, n.Destination)
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := markdown.Renderer().Render(&buf, source, doc); err != nil {
+		return "", err
+	}
+	return template.HTML(markdownPolicy.SanitizeBytes(buf.Bytes())), nil
+}
+
+// resolveRelative prefixes relative paths with base. URLs with a scheme,
+// absolute paths and fragments are returned as is.
+func resolveRelative(base string, dest []byte) []byte {
+	u, err := url.Parse(string(dest))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return dest
+	}
+	return []byte(base + string(dest))
+}
+
+// A dirReadme is the README of a directory. Markdown is rendered to HTML,
+// other files are shown as Text.
+type dirReadme struct {
+	Name string
+	HTML template.HTML
+	Text string
+}
+
+// readme returns the README of the directory at path, or nil if it has none.
+// The directory must already be authenticated.
+func (web *Web) readme(r *http.Request, path string) (*dirReadme, error) {
+	dir := web.fs.RealPath(path)
+	for _, name := range readmeNames {
+		source, err := readHead(filepath.Join(dir, name), maxMarkdownSize)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(name, ".md") {
+			return &dirReadme{Name: name, Text: string(source)}, nil
+		}
+		html, err := renderMarkdown(source, web.urlRoot(r)+"/view"+strings.TrimSuffix(escapePath(path), "/")+"/")
+		if err != nil {
+			return nil, err
+		}
+		return &dirReadme{Name: name, HTML: html}, nil
+	}
+	return nil, nil
+}
+
+// readHead reads at most n bytes from the start of a regular file.
+func readHead(filename string, n int64) ([]byte, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if info, err := fd.Stat(); err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+	return io.ReadAll(io.LimitReader(fd, n))
+}
+
+// renderMarkdownFile serves a markdown file as a sanitized HTML document,
+// which is sandboxed like the file itself.
+func (web *Web) renderMarkdownFile(w http.ResponseWriter, r *http.Request, file fs.File) {
+	source, err := readHead(file.Path, maxMarkdownSize)
+	if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not read markdown", "path", file.RelPath, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	dir := strings.TrimSuffix(escapePath(filepath.Dir(file.RelPath)), "/")
+	html, err := renderMarkdown(source, web.urlRoot(r)+"/view"+dir+"/")
+	if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not render markdown", "path", file.RelPath, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	userContentHeaders(w, file.Path, "text/html", false)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	args := web.baseTeplateArgs(r)
+	args["title"] = file.Name()
+	args["markdown"] = html
+	args["truncated"] = int64(len(source)) < file.Info.Size()
+	if err := web.pageTemplate("markdown.html").Execute(w, args); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,257 @@
+// Package metadata caches facts about files that are expensive to determine,
+// such as their MIME type or the thumber that accepts them. Facts are
+// discarded as soon as the size or modification time of a file changes.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"webfs/src/cache"
+	"webfs/src/logging"
+)
+
+var logger = logging.Component("metadata")
+
+var shared atomic.Pointer[Store]
+
+func init() {
+	shared.Store(NewStore())
+}
+
+// Shared returns the store that is used by all packages, which keeps its
+// facts in memory unless replaced with SetShared.
+func Shared() *Store {
+	return shared.Load()
+}
+
+// SetShared replaces the store returned by Shared.
+func SetShared(store *Store) {
+	shared.Store(store)
+}
+
+// A Store holds the facts about files. It is safe for concurrent use.
+type Store struct {
+	// The file the facts are persisted to, empty if they are only kept in
+	// memory.
+	filename string
+	version  string
+
+	lock    sync.Mutex
+	entries map[string]*entry
+	dirty   bool
+
+	hits, misses atomic.Uint64
+}
+
+type entry struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"` // In nanoseconds since the epoch.
+	// Facts by key. Facts loaded from disk are json.RawMessage until they
+	// are looked up.
+	Facts map[string]any `json:"facts"`
+}
+
+// persisted is the format of the file a store is saved to.
+type persisted struct {
+	Version string            `json:"version"`
+	Files   map[string]*entry `json:"files"`
+}
+
+// NewStore creates a store that keeps its facts in memory.
+func NewStore() *Store {
+	return &Store{entries: map[string]*entry{}}
+}
+
+// Open creates a store that is persisted to filename by Save. The facts
+// saved earlier are loaded, unless they were saved with another version,
+// which should change whenever the facts could be probed differently, e.g.
+// because a thumber became available. Facts about files that were changed or
+// removed in the meantime are dropped.
+func Open(filename, version string) (*Store, error) {
+	store := NewStore()
+	store.filename = filename
+	store.version = version
+
+	buf, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var p persisted
+	if err := json.Unmarshal(buf, &p); err != nil {
+		logger.Warn("Discarding unreadable metadata", "file", filename, "err", err)
+		return store, nil
+	}
+	if p.Version != version {
+		logger.Info("Discarding metadata of another version", "file", filename, "version", p.Version)
+		return store, nil
+	}
+	for name, e := range p.Files {
+		if info, err := os.Stat(name); err == nil && e.matches(info) {
+			for key, fact := range e.Facts {
+				raw, _ := json.Marshal(fact)
+				e.Facts[key] = json.RawMessage(raw)
+			}
+			store.entries[name] = e
+		}
+	}
+	return store, nil
+}
+
+func (e *entry) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano()
+}
+
+// Lookup returns the fact named key about a file. If it is not known or the
+// file has changed since, probe is called to determine it. Errors returned by
+// probe are not cached.
+func Lookup[T any](store *Store, filename, key string, probe func(filename string) (T, error)) (T, error) {
+	var zero T
+	info, err := os.Stat(filename)
+	if err != nil {
+		return zero, err
+	}
+
+	store.lock.Lock()
+	if e, ok := store.entries[filename]; ok && e.matches(info) {
+		if fact, ok := e.Facts[key]; ok {
+			if v, ok := fact.(T); ok {
+				store.lock.Unlock()
+				store.hits.Add(1)
+				return v, nil
+			}
+			var v T
+			if raw, ok := fact.(json.RawMessage); ok && json.Unmarshal(raw, &v) == nil {
+				e.Facts[key] = v
+				store.lock.Unlock()
+				store.hits.Add(1)
+				return v, nil
+			}
+		}
+	}
+	store.lock.Unlock()
+	store.misses.Add(1)
+
+	v, err := probe(filename)
+	if err != nil {
+		return zero, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	e, ok := store.entries[filename]
+	if !ok || !e.matches(info) {
+		e = &entry{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Facts:   map[string]any{},
+		}
+		store.entries[filename] = e
+	}
+	e.Facts[key] = v
+	store.dirty = true
+	return v, nil
+}
+
+// Stats reports the usage of the store. The size is not known and always 0.
+func (store *Store) Stats() cache.Stats {
+	store.lock.Lock()
+	entries := len(store.entries)
+	store.lock.Unlock()
+	return cache.Stats{
+		Hits:    store.hits.Load(),
+		Misses:  store.misses.Load(),
+		Entries: entries,
+	}
+}
+
+// Save writes the facts to the file of the store if they changed since they
+// were last saved. Facts about files that were changed or removed are dropped
+// first, so the store does not keep growing. It is a no-op for stores that are
+// kept in memory.
+func (store *Store) Save() error {
+	if store.filename == "" {
+		return nil
+	}
+	store.lock.Lock()
+	if !store.dirty {
+		store.lock.Unlock()
+		return nil
+	}
+	store.dirty = false
+	entries := make(map[string]*entry, len(store.entries))
+	for name, e := range store.entries {
+		entries[name] = e
+	}
+	store.lock.Unlock()
+
+	// The files are checked without holding the lock, entries are replaced
+	// rather than modified when a file changes.
+	for name, e := range entries {
+		if info, err := os.Stat(name); err == nil && e.matches(info) {
+			delete(entries, name)
+		}
+	}
+
+	store.lock.Lock()
+	for name, e := range entries {
+		if store.entries[name] == e {
+			delete(store.entries, name)
+		}
+	}
+	buf, err := json.Marshal(persisted{Version: store.version, Files: store.entries})
+	store.lock.Unlock()
+	if err == nil {
+		err = store.write(buf)
+	}
+	if err != nil {
+		// Try again on the next save.
+		store.lock.Lock()
+		store.dirty = true
+		store.lock.Unlock()
+	}
+	return err
+}
+
+func (store *Store) write(buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(store.filename), ".metadata-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), store.filename)
+}
+
+// SaveEvery saves the store at the interval until ctx is cancelled, after
+// which it is saved one last time.
+func (store *Store) SaveEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := store.Save(); err != nil {
+				logger.Error("Could not save metadata", "file", store.filename, "err", err)
+			}
+			return
+		}
+		if err := store.Save(); err != nil {
+			logger.Error("Could not save metadata", "file", store.filename, "err", err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package metrics defines the Prometheus metrics exported by webfs.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"webfs/src/cache"
+)
+
+const namespace = "webfs"
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+	HTTPResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_response_bytes_total",
+		Help:      "Number of bytes written in HTTP response bodies, by route.",
+	}, []string{"route"})
+
+	ThumbnailsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "thumbnails_generated_total",
+		Help:      "Number of thumbnails generated, by thumber.",
+	}, []string{"thumber"})
+	ThumbnailFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "thumbnail_failures_total",
+		Help:      "Number of thumbnails that could not be generated, by thumber.",
+	}, []string{"thumber"})
+	ThumbnailDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "thumbnail_duration_seconds",
+		Help:      "Time taken to generate thumbnails, by thumber.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"thumber"})
+
+	ActiveZips = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_zips",
+		Help:      "Number of zip archives that are being streamed.",
+	})
+	ActiveTranscodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_transcodes",
+		Help:      "Number of external media processes that are running, by command.",
+	}, []string{"command"})
+
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of failed authentication attempts, by method.",
+	}, []string{"method"})
+
+	PregenerationRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pregeneration_running",
+		Help:      "Whether thumbnails are being pregenerated.",
+	})
+	PregenerationFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pregeneration_files_total",
+		Help:      "Number of files found while pregenerating thumbnails.",
+	})
+	PregenerationProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pregeneration_processed_total",
+		Help:      "Number of files for which a thumbnail was pregenerated, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequests,
+		HTTPRequestDuration,
+		HTTPResponseBytes,
+		ThumbnailsGenerated,
+		ThumbnailFailures,
+		ThumbnailDuration,
+		ActiveZips,
+		ActiveTranscodes,
+		AuthFailures,
+		PregenerationRunning,
+		PregenerationFiles,
+		PregenerationProcessed,
+	)
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the count, duration and size of the requests handled by
+// the router. Routes are identified by their pattern.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		HTTPRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		HTTPResponseBytes.WithLabelValues(route).Add(float64(ww.BytesWritten()))
+	})
+}
+
+// statser is implemented by caches and other stores that report their usage.
+type statser interface {
+	Stats() cache.Stats
+}
+
+// cacheCollector reports the statistics of a cache when metrics are gathered.
+type cacheCollector struct {
+	name  string
+	cache statser
+
+	hits, misses, entries, size *prometheus.Desc
+}
+
+// RegisterCache exports the statistics of the cache under the specified name.
+func RegisterCache(name string, c statser) {
+	labels := prometheus.Labels{"cache": name}
+	prometheus.MustRegister(&cacheCollector{
+		name:    name,
+		cache:   c,
+		hits:    prometheus.NewDesc(namespace+"_cache_hits_total", "Number of lookups that found a cached file.", nil, labels),
+		misses:  prometheus.NewDesc(namespace+"_cache_misses_total", "Number of lookups that did not find a cached file.", nil, labels),
+		entries: prometheus.NewDesc(namespace+"_cache_entries", "Number of files in the cache.", nil, labels),
+		size:    prometheus.NewDesc(namespace+"_cache_size_bytes", "Total size of the files in the cache.", nil, labels),
+	})
+}
+
+func (cc *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.hits
+	ch <- cc.misses
+	ch <- cc.entries
+	ch <- cc.size
+}
+
+func (cc *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := cc.cache.Stats()
+	ch <- prometheus.MustNewConstMetric(cc.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cc.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(cc.entries, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(cc.size, prometheus.GaugeValue, float64(stats.Size))
+}
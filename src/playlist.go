@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"webfs/src/fs"
+	"webfs/src/thumb/audio"
+)
+
+// playlist serves the audio files of a directory as an M3U or PLS playlist,
+// depending on the extension of the path.
+func (web *Web) playlist(w http.ResponseWriter, r *http.Request) {
+	path := r.Context().Value(pathContextKey).(string)
+	format := filepath.Ext(path)
+	if format != ".m3u" && format != ".pls" {
+		http.NotFound(w, r)
+		return
+	}
+	path = strings.TrimSuffix(path, format)
+
+	page, err := web.fs.List(path, web.authenticator.FSAuthenticator(r), fs.ListOptions{Type: "audio/"})
+	if err == fs.ErrFileDoesNotExist || err == fs.ErrNotDirectory {
+		http.NotFound(w, r)
+		return
+	} else if err == fs.ErrNeedAuthentication {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	} else if err == fs.ErrAccessDenied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	} else if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not list directory", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	name := filepath.Base(path)
+	if name == "/" {
+		name = "webfs"
+	}
+	contentType := "audio/x-mpegurl"
+	if format == ".pls" {
+		contentType = "audio/x-scpls"
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{
+		"filename": name + format,
+	}))
+
+	urlRoot := web.urlRoot(r)
+	buf := bufio.NewWriter(w)
+	if format == ".m3u" {
+		fmt.Fprintln(buf, "#EXTM3U")
+		fmt.Fprintf(buf, "#PLAYLIST:%s\n", name)
+	} else {
+		fmt.Fprintln(buf, "[playlist]")
+	}
+	for i, file := range page.Files {
+		title := file.Name()
+		if tags, err := audio.ReadTags(file.Path); err != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not read tags", "path", file.RelPath, "err", err)
+		} else if tags.Title != "" && tags.Artist != "" {
+			title = tags.Artist + " - " + tags.Title
+		} else if tags.Title != "" {
+			title = tags.Title
+		}
+		// Line breaks would end the entry.
+		title = strings.Join(strings.Fields(title), " ")
+		url := urlRoot + "/get" + escapePath(file.RelPath)
+		// The duration is not known, which is denoted by -1.
+		if format == ".m3u" {
+			fmt.Fprintf(buf, "#EXTINF:-1,%s\n%s\n", title, url)
+		} else {
+			fmt.Fprintf(buf, "File%d=%s\nTitle%d=%s\nLength%d=-1\n", i+1, url, i+1, title, i+1)
+		}
+	}
+	if format == ".pls" {
+		fmt.Fprintf(buf, "NumberOfEntries=%d\nVersion=2\n", len(page.Files))
+	}
+	if err := buf.Flush(); err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not write playlist", "path", path, "err", err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+
+	"webfs/src/fs"
+	"webfs/src/thumb"
+)
+
+const (
+	// A page of a preview ends after this many lines or bytes, whichever
+	// comes first.
+	previewLines = 2000
+	previewBytes = 512 << 10
+	// Longer lines are cut off.
+	previewLineLength = 2000
+	// The number of bytes the charset of a file is detected from.
+	previewSniffLength = 64 << 10
+)
+
+// textTypes are the MIME types besides text/* that can be previewed.
+var textTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/toml",
+	"application/x-sh",
+	"application/x-yaml",
+	"application/xml",
+	"application/yaml",
+}
+
+func isText(mimeType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	for _, t := range textTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+var previewStyle = styles.Get("github")
+
+// previewCSS holds the classes of the highlighted tokens.
+var previewCSS = func() template.CSS {
+	var buf bytes.Buffer
+	if err := newPreviewFormatter(1).WriteCSS(&buf, previewStyle); err != nil {
+		panic(err)
+	}
+	return template.CSS(buf.String())
+}()
+
+func newPreviewFormatter(start int) *chromahtml.Formatter {
+	return chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.WithLinkableLineNumbers(true, "L"),
+		chromahtml.BaseLineNumber(start),
+		chromahtml.TabWidth(4),
+	)
+}
+
+// A previewPage is a part of a text file.
+type previewPage struct {
+	Text string
+	// The number of the first line and the number of lines on the page.
+	Start, Lines int
+	// The number of the first line of the page that ends right before this
+	// one, or 0 if this is the first page.
+	Prev int
+	// Whether the file continues after the page.
+	More bool
+	// Whether lines were cut off because they are too long.
+	Truncated bool
+}
+
+// End returns the number of the last line on the page.
+func (page previewPage) End() int {
+	return page.Start + page.Lines - 1
+}
+
+// readPreview reads the page of r that starts at the line numbered start.
+func readPreview(r io.Reader, start int) (previewPage, error) {
+	page := previewPage{Start: start}
+	br := bufio.NewReaderSize(r, 64<<10)
+	// The sizes of the lines before the page as they would appear on a
+	// page, the last previewLines of which are kept to find where the
+	// previous page starts.
+	sizes := make([]int, 0, min(start-1, previewLines))
+	for line := 1; line < start; line++ {
+		text, truncated, err := readLine(br, previewLineLength)
+		if err == io.EOF {
+			return page, nil
+		} else if err != nil {
+			return page, err
+		}
+		size := len(text) + 1
+		if truncated {
+			size += len(" …")
+		}
+		if len(sizes) == previewLines {
+			sizes = append(sizes[:0], sizes[1:]...)
+		}
+		sizes = append(sizes, size)
+	}
+	page.Prev = prevPageStart(start, sizes)
+
+	var buf strings.Builder
+	for page.Lines < previewLines && buf.Len() < previewBytes {
+		line, truncated, err := readLine(br, previewLineLength)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return page, err
+		}
+		buf.Write(line)
+		if truncated {
+			buf.WriteString(" …")
+			page.Truncated = true
+		}
+		buf.WriteByte('\n')
+		page.Lines++
+	}
+	_, err := br.Peek(1)
+	page.More = err == nil
+	page.Text = strings.ToValidUTF8(buf.String(), "\uFFFD")
+	if start == 1 {
+		page.Text = strings.TrimPrefix(page.Text, "\uFEFF")
+	}
+	return page, nil
+}
+
+// prevPageStart returns the first line of the page that ends right before the
+// line numbered start, given the sizes of the lines in front of it. The page
+// reaches the line before start as long as the lines before that one stay
+// under previewBytes. It may overlap the page at start if a long line in
+// front of it keeps it from starting earlier.
+func prevPageStart(start int, sizes []int) int {
+	if start <= 1 {
+		return 0
+	}
+	prev, n := start-1, 0
+	for i := len(sizes) - 2; i >= 0 && n+sizes[i] < previewBytes; i-- {
+		prev, n = prev-1, n+sizes[i]
+	}
+	return prev
+}
+
+// readLine reads the next line without the line ending. Only the first limit
+// bytes are kept, truncated is set if the line was longer. io.EOF is only
+// returned if there are no more lines.
+func readLine(br *bufio.Reader, limit int) (line []byte, truncated bool, err error) {
+	read := false
+	for {
+		chunk, err := br.ReadSlice('\n')
+		read = read || len(chunk) > 0
+		chunk = bytes.TrimSuffix(chunk, []byte("\n"))
+		if n := limit - len(line); len(chunk) > n {
+			line = append(line, chunk[:n]...)
+			truncated = true
+		} else {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && read {
+			err = nil
+		}
+		if !truncated {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+		}
+		return line, truncated, err
+	}
+}
+
+// preview renders a page of a text file with syntax highlighting. The page
+// starts at the line in the line query parameter.
+func (web *Web) preview(w http.ResponseWriter, r *http.Request) {
+	path := r.Context().Value(pathContextKey).(string)
+	filename, err := web.fs.Filepath(path, web.authenticator.FSAuthenticator(r))
+	if err == fs.ErrFileDoesNotExist {
+		http.NotFound(w, r)
+		return
+	} else if err == fs.ErrNeedAuthentication {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	} else if err == fs.ErrAccessDenied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	} else if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not get file path", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	start := 1
+	if s := r.URL.Query().Get("line"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil || start < 1 {
+			http.Error(w, "invalid line", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fd, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not open file", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	// Every line but the last ends in at least one byte, so lines beyond
+	// the size do not exist and the file need not be read to find out.
+	if int64(start) > info.Size()+1 {
+		http.Error(w, "invalid line", http.StatusBadRequest)
+		return
+	}
+	mimeType, err := thumb.MimeType(filename)
+	if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not determine file type", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !isText(mimeType) {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// The charset parameter of types derived from the extension is a guess,
+	// so the charset is detected from the content.
+	head := make([]byte, previewSniffLength)
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		httpLogger.ErrorContext(r.Context(), "Could not read file", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	encoding, encodingName, _ := charset.DetermineEncoding(head[:n], mediaType)
+	if encodingName == "windows-1252" && isASCII(head[:n]) {
+		// The fallback of DetermineEncoding, but ASCII is more likely the
+		// start of UTF-8.
+		encodingName = "utf-8"
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not read file", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var reader io.Reader = fd
+	if encodingName != "utf-8" {
+		reader = transform.NewReader(fd, encoding.NewDecoder())
+	}
+
+	page, err := readPreview(reader, start)
+	if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not read file", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	lexer := lexers.Match(filepath.Base(filename))
+	if lexer == nil {
+		lexer = lexers.MatchMimeType(mediaType)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(page.Text)
+	}
+	if lexer == nil {
+		lexer = lexers.Get("plaintext")
+	}
+	lexer = chroma.Coalesce(lexer)
+	var code bytes.Buffer
+	iterator, err := lexer.Tokenise(nil, page.Text)
+	if err == nil {
+		err = newPreviewFormatter(start).Format(&code, previewStyle, iterator)
+	}
+	if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not highlight file", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	args := web.baseTeplateArgs(r)
+	args["path"] = path
+	args["breadcrumbs"] = breadcrumbs(filepath.Dir(path))
+	args["name"] = filepath.Base(path)
+	args["code"] = template.HTML(code.String())
+	args["css"] = previewCSS
+	args["language"] = lexer.Config().Name
+	args["encoding"] = encodingName
+	args["page"] = page
+	args["embed"] = r.URL.Query().Get("embed") != ""
+	args["prev"] = ""
+	if page.Prev > 0 {
+		args["prev"] = previewQuery(r, page.Prev)
+	}
+	args["next"] = ""
+	if page.More {
+		args["next"] = previewQuery(r, start+page.Lines)
+	}
+	args["title"] = filepath.Base(path)
+	if err := web.pageTemplate("preview.html").Execute(w, args); err != nil {
+		panic(err)
+	}
+}
+
+func isASCII(buf []byte) bool {
+	for _, b := range buf {
+		if b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// previewQuery returns the query string of the page of a preview that starts
+// at line.
+func previewQuery(r *http.Request, line int) string {
+	query := r.URL.Query()
+	query.Set("line", fmt.Sprint(line))
+	return "?" + query.Encode()
+}
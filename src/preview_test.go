@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadPreviewPrev(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{"short lines", repeatLines("x", previewLines*3+5)},
+		// Pages of long lines are cut by previewBytes long before
+		// previewLines.
+		{"long lines", repeatLines(strings.Repeat("x", previewLineLength-1), previewLines)},
+		{"truncated lines", repeatLines(strings.Repeat("x", previewLineLength*2), previewLines)},
+		{"mixed lines", append(repeatLines("x", previewLines+10), repeatLines(strings.Repeat("y", 1000), 1200)...)},
+	}
+	for _, test := range tests {
+		text := strings.Join(test.lines, "\n") + "\n"
+		// Page forward to the end, then back again. Every page going
+		// back must end right before the page after it.
+		start := 1
+		for {
+			page, err := readPreview(strings.NewReader(text), start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !page.More {
+				break
+			}
+			start += page.Lines
+		}
+		if start == 1 {
+			t.Fatalf("%s: the file has a single page", test.name)
+		}
+		for pages := 0; start > 1; pages++ {
+			if pages > len(test.lines) {
+				t.Fatalf("%s: paging back does not end", test.name)
+			}
+			page, err := readPreview(strings.NewReader(text), start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Prev < 1 || page.Prev >= start {
+				t.Fatalf("%s: the page at %d goes back to %d", test.name, start, page.Prev)
+			}
+			prev, err := readPreview(strings.NewReader(text), page.Prev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prev.End() < start-1 {
+				t.Errorf("%s: the page before %d ends at %d", test.name, start, prev.End())
+			}
+			if page.Prev > 1 && prev.End() != start-1 && prev.Lines == previewLines {
+				t.Errorf("%s: the page before %d overlaps it up to %d", test.name, start, prev.End())
+			}
+			start = page.Prev
+		}
+		if page, _ := readPreview(strings.NewReader(text), 1); page.Prev != 0 {
+			t.Errorf("%s: the first page goes back to %d", test.name, page.Prev)
+		}
+	}
+}
+
+func repeatLines(line string, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = line
+	}
+	return lines
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies is a list of networks of reverse proxies whose forwarding
+// headers may be believed.
+type TrustedProxies struct {
+	networks []*net.IPNet
+	// Whether peers connecting through a Unix domain socket are trusted.
+	unix bool
+}
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// networks. The word "unix" trusts all peers connecting through a Unix domain
+// socket.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if field == "unix" {
+			proxies.unix = true
+			continue
+		}
+		network, err := parseNetwork(field)
+		if err != nil {
+			return TrustedProxies{}, err
+		}
+		proxies.networks = append(proxies.networks, network)
+	}
+	return proxies, nil
+}
+
+// parseNetwork parses an address in CIDR notation. A plain IP address is
+// interpreted as a network containing only that address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %q", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	for _, network := range tp.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrusted checks whether the request was made directly by a trusted proxy.
+// Requests received on a Unix domain socket have no address, they are only
+// trusted if all local processes with access to the socket are.
+func (tp TrustedProxies) IsTrusted(r *http.Request) bool {
+	if viaUnixSocket(r) {
+		return tp.unix
+	}
+	ip := remoteIP(r)
+	return ip != nil && tp.Contains(ip)
+}
+
+// ClientIP determines the address of the client that made the request. If the
+// request was received from a trusted proxy, the X-Forwarded-For header is
+// walked from right to left until an untrusted address is found.
+func (tp TrustedProxies) ClientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !tp.IsTrusted(r) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !tp.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// ExternalRoot returns the scheme, host and path prefix under which the client
+// reached webfs. If the request was made by a trusted proxy, they are taken
+// from the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers.
+func (tp TrustedProxies) ExternalRoot(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	var prefix string
+	if tp.IsTrusted(r) {
+		if proto := lastForwarded(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if h := lastForwarded(r, "X-Forwarded-Host"); h != "" && !strings.ContainsAny(h, "/\\@ ") {
+			host = h
+		}
+		if p := lastForwarded(r, "X-Forwarded-Prefix"); strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") {
+			prefix = strings.TrimRight(p, "/")
+		}
+	}
+	return scheme + "://" + host + prefix
+}
+
+// lastForwarded returns the last value of a forwarding header. Proxies that
+// append to the header instead of replacing it leave the values sent by the
+// client in front, the last value is set by the trusted proxy itself.
+func lastForwarded(r *http.Request, header string) string {
+	values := strings.Split(strings.Join(r.Header.Values(header), ","), ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// unixSocketConnContext marks requests on connections accepted from a Unix
+// domain socket. It is intended to be used as http.Server.ConnContext.
+func unixSocketConnContext(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.LocalAddr().(*net.UnixAddr); ok {
+		return context.WithValue(ctx, unixSocketContextKey, true)
+	}
+	return ctx
+}
+
+func viaUnixSocket(r *http.Request) bool {
+	unix, _ := r.Context().Value(unixSocketContextKey).(bool)
+	return unix
+}
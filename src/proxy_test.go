@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesUnixSocket(t *testing.T) {
+	socketRequest := func() *http.Request {
+		r := httptest.NewRequest("GET", "/view/", nil)
+		r.RemoteAddr = "@"
+		r.Header.Set("X-Forwarded-For", "10.1.2.3")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "files.example.com")
+		return r.WithContext(context.WithValue(r.Context(), unixSocketContextKey, true))
+	}
+
+	tests := []struct {
+		proxies string
+		trusted bool
+		ip      string
+		root    string
+	}{
+		{"", false, "<nil>", "http://example.com"},
+		{"127.0.0.1, 10.0.0.0/8", false, "<nil>", "http://example.com"},
+		{"127.0.0.1, unix", true, "10.1.2.3", "https://files.example.com"},
+	}
+	for _, test := range tests {
+		tp, err := ParseTrustedProxies(test.proxies)
+		if err != nil {
+			t.Fatalf("ParseTrustedProxies(%q): %v", test.proxies, err)
+		}
+		r := socketRequest()
+		if trusted := tp.IsTrusted(r); trusted != test.trusted {
+			t.Errorf("IsTrusted() with %q = %v, want %v", test.proxies, trusted, test.trusted)
+		}
+		if ip := tp.ClientIP(r).String(); ip != test.ip {
+			t.Errorf("ClientIP() with %q = %s, want %s", test.proxies, ip, test.ip)
+		}
+		if root := tp.ExternalRoot(r); root != test.root {
+			t.Errorf("ExternalRoot() with %q = %q, want %q", test.proxies, root, test.root)
+		}
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	tp, err := ParseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"192.0.2.1:1234", "10.1.2.3", "192.0.2.1"},
+		{"127.0.0.1:1234", "192.0.2.7, 10.1.2.3", "192.0.2.7"},
+		{"127.0.0.1:1234", "198.51.100.1, 192.0.2.7", "192.0.2.7"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/view/", nil)
+		r.RemoteAddr = test.remote
+		r.Header.Set("X-Forwarded-For", test.forwarded)
+		if ip := tp.ClientIP(r).String(); ip != test.want {
+			t.Errorf("ClientIP() from %s with %q = %s, want %s", test.remote, test.forwarded, ip, test.want)
+		}
+	}
+}
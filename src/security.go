@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	csrfCookieName = "csrf"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// Files of these types may run scripts when opened by a browser. They are
+// always served as attachments so they can not run in the origin of webfs.
+var activeContentTypes = []string{
+	"application/javascript",
+	"application/xhtml+xml",
+	"application/xml",
+	"image/svg+xml",
+	"text/html",
+	"text/javascript",
+	"text/xml",
+}
+
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// securityHeaders sets headers hardening all responses against clickjacking,
+// content sniffing and script injection. The Content-Security-Policy only
+// allows inline scripts carrying the per-request nonce that is exposed to
+// templates as cspNonce. Images may also be loaded from the map tile server.
+func securityHeaders(config func() *Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nonce := randomToken(16)
+			config := config()
+			piwikRoot := config.UI.PiwikRoot
+
+			scriptSrc := []string{"'self'", "'nonce-" + nonce + "'"}
+			imgSrc := []string{"'self'", "data:"}
+			connectSrc := []string{"'self'"}
+			if piwikRoot != "" {
+				scriptSrc = append(scriptSrc, piwikRoot+"/")
+				imgSrc = append(imgSrc, piwikRoot+"/")
+				connectSrc = append(connectSrc, piwikRoot+"/")
+			}
+			if origin := config.Map.tileOrigin(); origin != "" {
+				imgSrc = append(imgSrc, origin)
+			}
+			csp := []string{
+				"default-src 'self'",
+				"script-src " + strings.Join(scriptSrc, " "),
+				"style-src 'self' 'unsafe-inline'",
+				"img-src " + strings.Join(imgSrc, " "),
+				"connect-src " + strings.Join(connectSrc, " "),
+				"object-src 'none'",
+				"base-uri 'none'",
+				"form-action 'self'",
+				"frame-ancestors 'self'",
+			}
+
+			h := w.Header()
+			h.Set("Content-Security-Policy", strings.Join(csp, "; "))
+			h.Set("X-Frame-Options", "SAMEORIGIN")
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("Referrer-Policy", "same-origin")
+
+			ctx := context.WithValue(r.Context(), cspNonceContextKey, nonce)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceContextKey).(string)
+	return nonce
+}
+
+// userContentHeaders prepares the response for serving a file from the
+// filesystem. The file is sandboxed so that uploaded HTML or SVG can not run
+// scripts with access to webfs. If attachment is set, active content is
+// offered as a download instead of being displayed.
+func userContentHeaders(w http.ResponseWriter, filename, contentType string, attachment bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	active := false
+	for _, t := range activeContentTypes {
+		if mediaType == t {
+			active = true
+			break
+		}
+	}
+
+	h := w.Header()
+	// Browsers refuse to display PDFs in sandboxed documents.
+	if mediaType != "application/pdf" {
+		h.Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'")
+	}
+	disposition := "inline"
+	if attachment && active {
+		disposition = "attachment"
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": filepath.Base(filename),
+	}))
+}
+
+// csrfProtect rejects state changing requests that do not carry the token
+// from the csrf cookie in either a form field or header. The token is exposed
+// to templates as csrfToken.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			token = randomToken(32)
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		default:
+			submitted := r.Header.Get(csrfHeader)
+			if submitted == "" {
+				submitted = r.PostFormValue(csrfFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+				http.Error(w, fmt.Sprintf("%s: invalid CSRF token", http.StatusText(http.StatusForbidden)), http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), csrfContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey).(string)
+	return token
+}
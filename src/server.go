@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed using the systemd socket
+// activation protocol.
+const listenFdsStart = 3
+
+const unixAddressPrefix = "unix:"
+
+// A listenerGroup is a set of listeners that are served by the same server.
+// The name identifies the listeners when they are passed to a new process.
+type listenerGroup struct {
+	name      string
+	server    *http.Server
+	listeners []net.Listener
+}
+
+// listen opens a listener for the address. Addresses starting with "unix:" are
+// paths of Unix domain sockets, which are created with the specified mode and
+// group. A socket left behind by a previous process is replaced.
+func listen(addr string, mode os.FileMode, group string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixAddressPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixAddressPrefix)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// inheritedListeners returns the listening sockets passed to the process using
+// the systemd socket activation protocol, grouped by the names passed in
+// LISTEN_FDNAMES. The sockets are either passed by systemd or by a previous
+// webfs process that is restarting.
+func inheritedListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := map[string][]net.Listener{}
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listener-%d", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, group := range listeners {
+				for _, l := range group {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("inherited file descriptor %d: %v", fd, err)
+		}
+		var name string
+		if i := fd - listenFdsStart; i < len(names) {
+			name = names[i]
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
+
+// restart starts a new webfs process with the same arguments that takes over
+// the listeners. The new process starts accepting connections right away,
+// while this process is still able to finish active requests.
+func restart(groups []listenerGroup) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	defer func() {
+		for _, f := range files[listenFdsStart:] {
+			f.Close()
+		}
+	}()
+	var names []string
+	for _, group := range groups {
+		for _, l := range group.listeners {
+			fl, ok := l.(interface{ File() (*os.File, error) })
+			if !ok {
+				return fmt.Errorf("can not pass listener %v to a new process", l.Addr())
+			}
+			f, err := fl.File()
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+			names = append(names, group.name)
+		}
+	}
+
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "LISTEN_") {
+			env = append(env, v)
+		}
+	}
+	env = append(env, fmt.Sprintf("LISTEN_FDS=%d", len(names)))
+	env = append(env, "LISTEN_FDNAMES="+strings.Join(names, ":"))
+
+	proc, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+	if err != nil {
+		return err
+	}
+	// The sockets are in use by the new process, they must stay in place
+	// when this process closes its listeners.
+	for _, group := range groups {
+		for _, l := range group.listeners {
+			if ul, ok := l.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+	}
+	serverLogger.Info("Started new process", "pid", proc.Pid)
+	return proc.Release()
+}
+
+// serve accepts connections on the listeners of all groups until the process
+// is asked to stop. On SIGINT or SIGTERM, the servers stop accepting new
+// connections and wait for active requests to complete. On SIGUSR2, a new
+// process takes over the listeners first. Requests that are still active once
+// the timeout has expired are aborted.
+func serve(groups []listenerGroup, shutdownTimeout func() time.Duration) error {
+	n := 0
+	for _, group := range groups {
+		n += len(group.listeners)
+	}
+	errs := make(chan error, n)
+	for _, group := range groups {
+		// The server may initialize its TLSConfig once it is serving, so TLS
+		// must be determined before the first listener is served.
+		server := group.server
+		serveTLS := server.TLSConfig != nil
+		for _, l := range group.listeners {
+			// Unix domain sockets are local and meant for reverse
+			// proxies, which terminate TLS themselves.
+			tls := serveTLS && l.Addr().Network() != "unix"
+			serverLogger.Info("Now accepting HTTP connections", "addr", l.Addr(), "group", group.name, "tls", tls)
+			go func(l net.Listener) {
+				if tls {
+					errs <- server.ServeTLS(l, "", "")
+				} else {
+					errs <- server.Serve(l)
+				}
+			}(l)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case err := <-errs:
+			if err != http.ErrServerClosed {
+				return err
+			}
+		case s := <-sig:
+			if s == syscall.SIGUSR2 {
+				if err := restart(groups); err != nil {
+					serverLogger.Error("Could not restart", "err", err)
+					continue
+				}
+			}
+			timeout := shutdownTimeout()
+			serverLogger.Info("Shutting down, waiting for active requests", "timeout", timeout)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			return shutdown(ctx, groups)
+		}
+	}
+}
+
+// shutdown gracefully stops the servers of all groups at the same time.
+func shutdown(ctx context.Context, groups []listenerGroup) error {
+	errs := make(chan error, len(groups))
+	for _, group := range groups {
+		go func(server *http.Server) {
+			err := server.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				serverLogger.Warn("Shutdown timeout expired, aborting active requests")
+				err = server.Close()
+			}
+			errs <- err
+		}(group.server)
+	}
+	var firstErr error
+	for range groups {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
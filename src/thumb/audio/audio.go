@@ -0,0 +1,189 @@
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+
+	"github.com/nfnt/resize"
+
+	"webfs/src/metadata"
+	"webfs/src/thumb"
+)
+
+func init() {
+	thumb.RegisterThumber(AudioThumber{})
+}
+
+// The images in the directory of an audio file that are used as its cover if
+// it has none embedded, in order of preference.
+var folderImages = []string{
+	"cover.jpg", "Cover.jpg", "folder.jpg", "Folder.jpg", "front.jpg", "Front.jpg",
+	"cover.png", "Cover.png", "folder.png", "Folder.png",
+}
+
+// Types are the MIME types of the audio files whose tags are read.
+var Types = []string{
+	"audio/flac",
+	"audio/mp4",
+	"audio/mpeg",
+	"audio/x-flac",
+	"audio/x-m4a",
+}
+
+// AudioThumber shows the cover art of audio files.
+type AudioThumber struct{}
+
+// Accepts only considers the cover embedded in the file, as the decision is
+// cached until the file changes. Covers next to it are found by
+// AcceptsFallback.
+func (AudioThumber) Accepts(filename string) (bool, error) {
+	cover, err := embeddedCover(filename)
+	return cover != nil, err
+}
+
+func (AudioThumber) AcceptsFallback(filename string) (bool, error) {
+	ok, err := thumb.AcceptMimes(filename,
+		"audio/aac",
+		"audio/flac",
+		"audio/mp4",
+		"audio/mpeg",
+		"audio/ogg",
+		"audio/wav",
+		"audio/webm",
+		"audio/x-flac",
+		"audio/x-m4a",
+		"audio/x-wav",
+	)
+	if !ok || err != nil {
+		return false, err
+	}
+	name, err := folderImage(filepath.Dir(filename))
+	return name != "", err
+}
+
+func (AudioThumber) Thumb(filename string, w, h int) (image.Image, error) {
+	cover, err := Cover(filename)
+	if err != nil {
+		return nil, err
+	} else if cover == nil {
+		return nil, fmt.Errorf("%q has no cover", filename)
+	}
+	img, _, err := image.Decode(bytes.NewReader(cover))
+	if err != nil {
+		return nil, err
+	}
+	return fill(img, w, h), nil
+}
+
+// fill scales img to cover a w by h image and crops the overflow at both
+// sides.
+func fill(img image.Image, w, h int) image.Image {
+	var src image.Image
+	if img.Bounds().Dx()*h > img.Bounds().Dy()*w {
+		src = resize.Resize(0, uint(h), img, resize.Bilinear)
+	} else {
+		src = resize.Resize(uint(w), 0, img, resize.Bilinear)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	// Rounding may leave the scaled image a pixel short.
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min.Add(image.Point{
+		X: max(0, (src.Bounds().Dx()-w)/2),
+		Y: max(0, (src.Bounds().Dy()-h)/2),
+	}), draw.Src)
+	return dst
+}
+
+// CacheKey identifies the image in the directory of an audio file that may be
+// used as its cover, so its thumbnail is made again when the image changes.
+func (AudioThumber) CacheKey(filename string) (string, error) {
+	dir := filepath.Dir(filename)
+	name, err := folderImage(dir)
+	if err != nil || name == "" {
+		return "", err
+	}
+	info, err := os.Stat(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%d", name, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// ReadTags returns the tags of an audio file, which are cached in the shared
+// metadata store. Files of other types than Types have no tags.
+func ReadTags(filename string) (Tags, error) {
+	return metadata.Lookup(metadata.Shared(), filename, "tags", func(filename string) (Tags, error) {
+		if ok, err := thumb.AcceptMimes(filename, Types...); !ok || err != nil {
+			return Tags{}, err
+		}
+		fd, err := os.Open(filename)
+		if err != nil {
+			return Tags{}, err
+		}
+		defer fd.Close()
+		tags, _, err := readTags(fd)
+		if err != nil {
+			// Broken tags are not worth retrying.
+			return Tags{}, nil
+		}
+		return tags, nil
+	})
+}
+
+// Cover returns the cover art embedded in an audio file, or the first of the
+// folderImages next to it. It returns nil if there is neither.
+func Cover(filename string) ([]byte, error) {
+	if cover, err := embeddedCover(filename); cover != nil || err != nil {
+		return cover, err
+	}
+	dir := filepath.Dir(filename)
+	name, err := folderImage(dir)
+	if err != nil || name == "" {
+		return nil, err
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
+
+// embeddedCover returns the cover art embedded in an audio file, or nil if it
+// has none. Files of other types than Types have no embedded cover.
+func embeddedCover(filename string) ([]byte, error) {
+	if ok, err := thumb.AcceptMimes(filename, Types...); !ok || err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if _, picture, err := readTags(fd); err == nil {
+		return picture, nil
+	}
+	return nil, nil
+}
+
+// folderImage returns the name of the first of the folderImages in dir, or ""
+// if there is none. It is cached in the shared metadata store until an entry
+// of the directory is added or removed, which changes its modification time.
+func folderImage(dir string) (string, error) {
+	return metadata.Lookup(metadata.Shared(), dir, "folder-image", func(dir string) (string, error) {
+		for _, name := range folderImages {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return name, nil
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+		return "", nil
+	})
+}
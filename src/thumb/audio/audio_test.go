@@ -0,0 +1,76 @@
+package audio
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFill(t *testing.T) {
+	tests := []struct {
+		srcW, srcH int
+		w, h       int
+	}{
+		{300, 300, 200, 200},
+		{400, 300, 200, 100},
+		{400, 300, 100, 200},
+		{100, 400, 100, 200},
+		{100, 400, 200, 100},
+		{333, 200, 160, 90},
+		{7, 3, 160, 90},
+	}
+	for _, test := range tests {
+		src := image.NewRGBA(image.Rect(0, 0, test.srcW, test.srcH))
+		for y := 0; y < test.srcH; y++ {
+			for x := 0; x < test.srcW; x++ {
+				src.Set(x, y, color.RGBA{R: 255, A: 255})
+			}
+		}
+		dst := fill(src, test.w, test.h)
+		if dst.Bounds() != image.Rect(0, 0, test.w, test.h) {
+			t.Errorf("fill(%dx%d, %d, %d) has bounds %v", test.srcW, test.srcH, test.w, test.h, dst.Bounds())
+			continue
+		}
+		// The cover must reach every edge of the thumbnail.
+		for _, p := range []image.Point{{0, 0}, {test.w - 1, 0}, {0, test.h - 1}, {test.w - 1, test.h - 1}, {test.w / 2, test.h / 2}} {
+			if _, _, _, a := dst.At(p.X, p.Y).RGBA(); a == 0 {
+				t.Errorf("fill(%dx%d, %d, %d) leaves %v uncovered", test.srcW, test.srcH, test.w, test.h, p)
+			}
+		}
+	}
+}
+
+func TestCacheKeyFolderImage(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "track.mp3")
+	if err := os.WriteFile(filename, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := func() string {
+		t.Helper()
+		key, err := AudioThumber{}.CacheKey(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	if k := key(); k != "" {
+		t.Errorf("CacheKey() without a folder image = %q, want none", k)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "folder.jpg"), []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first := key()
+	if first == "" {
+		t.Fatal("CacheKey() ignores the folder image")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "folder.jpg"), []byte("second cover"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if second := key(); second == first {
+		t.Errorf("CacheKey() = %q did not change with the folder image", second)
+	}
+}
@@ -0,0 +1,488 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Tags are the metadata of an audio file. Fields that are not tagged are
+// empty.
+type Tags struct {
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	Track  int    `json:"track,omitempty"`
+	Year   string `json:"year,omitempty"`
+}
+
+// Pictures of this ID3 and FLAC type are preferred over other pictures.
+const frontCover = 3
+
+// Tag blocks larger than this are not read.
+const maxTagSize = 32 << 20
+
+var errInvalidTag = errors.New("invalid tag")
+
+// readTags reads the tags and the embedded cover art of an MP3, FLAC or MP4
+// file. Files in other formats have no tags.
+func readTags(r io.ReadSeeker) (Tags, []byte, error) {
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Tags{}, nil, nil
+	} else if err != nil {
+		return Tags{}, nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Tags{}, nil, err
+	}
+	switch {
+	case string(magic[:4]) == "fLaC":
+		return readFLAC(r)
+	case string(magic[:3]) == "ID3":
+		tags, picture, err := readID3(r)
+		if err != nil {
+			return tags, picture, err
+		}
+		// FLAC files may start with an ID3 tag, which is skipped by
+		// decoders and usually empty.
+		if _, err := io.ReadFull(r, magic[:4]); err == nil && string(magic[:4]) == "fLaC" {
+			if _, err := r.Seek(-4, io.SeekCurrent); err != nil {
+				return tags, picture, err
+			}
+			return readFLAC(r)
+		}
+		return tags, picture, nil
+	case string(magic[4:]) == "ftyp":
+		return readMP4(r)
+	}
+	return Tags{}, nil, nil
+}
+
+// readID3 reads an ID3v2.2, 2.3 or 2.4 tag at the start of r and leaves r
+// after it.
+func readID3(r io.Reader) (Tags, []byte, error) {
+	var header [10]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Tags{}, nil, err
+	}
+	version, flags := header[3], header[5]
+	size := syncsafe(header[6:10])
+	if version < 2 || version > 4 || size > maxTagSize {
+		return Tags{}, nil, errInvalidTag
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Tags{}, nil, err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		buf = bytes.ReplaceAll(buf, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags&0x40 != 0 && version > 2 && len(buf) >= 4 {
+		// Skip the extended header.
+		n := int(binary.BigEndian.Uint32(buf) + 4)
+		if version == 4 {
+			n = syncsafe(buf[:4])
+		}
+		if n > len(buf) {
+			return Tags{}, nil, errInvalidTag
+		}
+		buf = buf[n:]
+	}
+
+	idLen, headerLen := 4, 10
+	names := map[string]string{
+		"TIT2": "title", "TPE1": "artist", "TALB": "album", "TRCK": "track",
+		"TYER": "year", "TDRC": "year", "APIC": "picture",
+	}
+	if version == 2 {
+		idLen, headerLen = 3, 6
+		names = map[string]string{
+			"TT2": "title", "TP1": "artist", "TAL": "album", "TRK": "track",
+			"TYE": "year", "PIC": "picture",
+		}
+	}
+
+	var tags Tags
+	var picture []byte
+	pictureType := -1
+	for len(buf) >= headerLen && buf[0] != 0 {
+		id := string(buf[:idLen])
+		var size int
+		switch version {
+		case 2:
+			size = int(buf[3])<<16 | int(buf[4])<<8 | int(buf[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(buf[4:8]))
+		case 4:
+			size = syncsafe(buf[4:8])
+		}
+		if size > len(buf)-headerLen {
+			break
+		}
+		data := buf[headerLen : headerLen+size]
+		if version == 4 {
+			formatFlags := buf[9]
+			if formatFlags&0x01 != 0 && len(data) >= 4 {
+				data = data[4:] // The data length indicator.
+			}
+			if formatFlags&0x02 != 0 {
+				data = bytes.ReplaceAll(data, []byte{0xff, 0x00}, []byte{0xff})
+			}
+		}
+		buf = buf[headerLen+size:]
+
+		switch names[id] {
+		case "title":
+			tags.Title = id3Text(data)
+		case "artist":
+			tags.Artist = id3Text(data)
+		case "album":
+			tags.Album = id3Text(data)
+		case "track":
+			tags.Track = trackNumber(id3Text(data))
+		case "year":
+			tags.Year = year(id3Text(data))
+		case "picture":
+			if t, p := id3Picture(data, version == 2); p != nil && pictureType != frontCover {
+				picture, pictureType = p, t
+			}
+		}
+	}
+	return tags, picture, nil
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3Text decodes the first value of a text frame.
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	text, _ := id3String(data[0], data[1:])
+	return strings.TrimSpace(text)
+}
+
+// id3String decodes a null terminated string in the encoding and returns the
+// rest of data after it.
+func id3String(encoding byte, data []byte) (string, []byte) {
+	switch encoding {
+	case 1, 2: // UTF-16 with a byte order mark, UTF-16BE.
+		end := len(data)
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+		rest := data[min(end+2, len(data)):]
+		s := data[:end]
+		var order binary.ByteOrder = binary.BigEndian
+		if len(s) >= 2 && s[0] == 0xff && s[1] == 0xfe {
+			order, s = binary.LittleEndian, s[2:]
+		} else if len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff {
+			s = s[2:]
+		}
+		units := make([]uint16, len(s)/2)
+		for i := range units {
+			units[i] = order.Uint16(s[2*i:])
+		}
+		return string(utf16.Decode(units)), rest
+	default: // ISO-8859-1 or UTF-8.
+		end := bytes.IndexByte(data, 0)
+		rest := []byte(nil)
+		if end < 0 {
+			end = len(data)
+		} else {
+			rest = data[end+1:]
+		}
+		if encoding == 3 {
+			return string(data[:end]), rest
+		}
+		runes := make([]rune, end)
+		for i, b := range data[:end] {
+			runes[i] = rune(b)
+		}
+		return string(runes), rest
+	}
+}
+
+// id3Picture returns the type and the image of an APIC frame, or a PIC frame
+// of ID3v2.2.
+func id3Picture(data []byte, v22 bool) (int, []byte) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	encoding, data := data[0], data[1:]
+	if v22 {
+		if len(data) < 3 {
+			return 0, nil
+		}
+		data = data[3:] // The image format, e.g. JPG.
+	} else {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return 0, nil
+		}
+		data = data[end+1:] // The MIME type.
+	}
+	if len(data) < 1 {
+		return 0, nil
+	}
+	pictureType := int(data[0])
+	_, data = id3String(encoding, data[1:]) // The description.
+	if len(data) == 0 {
+		return 0, nil
+	}
+	return pictureType, data
+}
+
+// readFLAC reads the Vorbis comments and the picture of a FLAC stream.
+func readFLAC(r io.Reader) (Tags, []byte, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return Tags{}, nil, err
+	}
+	var tags Tags
+	var picture []byte
+	pictureType := -1
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return tags, picture, err
+		}
+		last, blockType := header[0]&0x80 != 0, header[0]&0x7f
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		switch blockType {
+		case 4, 6: // VORBIS_COMMENT, PICTURE
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return tags, picture, err
+			}
+			if blockType == 4 {
+				vorbisComments(data, &tags)
+			} else if t, p := flacPicture(data); p != nil && pictureType != frontCover {
+				picture, pictureType = p, t
+			}
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+				return tags, picture, err
+			}
+		}
+		if last {
+			return tags, picture, nil
+		}
+	}
+}
+
+func vorbisComments(data []byte, tags *Tags) {
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return nil, false
+		}
+		s := data[4 : 4+n]
+		data = data[4+n:]
+		return s, true
+	}
+	if _, ok := next(); !ok { // The vendor.
+		return
+	}
+	if len(data) < 4 {
+		return
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			return
+		}
+		key, value, _ := strings.Cut(string(comment), "=")
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			tags.Title = value
+		case "ARTIST":
+			tags.Artist = value
+		case "ALBUM":
+			tags.Album = value
+		case "TRACKNUMBER":
+			tags.Track = trackNumber(value)
+		case "DATE":
+			tags.Year = year(value)
+		}
+	}
+}
+
+func flacPicture(data []byte) (int, []byte) {
+	field := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return nil, false
+		}
+		s := data[4 : 4+n]
+		data = data[4+n:]
+		return s, true
+	}
+	if len(data) < 4 {
+		return 0, nil
+	}
+	pictureType := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if _, ok := field(); !ok { // The MIME type.
+		return 0, nil
+	}
+	if _, ok := field(); !ok { // The description.
+		return 0, nil
+	}
+	if len(data) < 16 {
+		return 0, nil
+	}
+	data = data[16:] // The dimensions, color depth and palette size.
+	picture, ok := field()
+	if !ok || len(picture) == 0 {
+		return 0, nil
+	}
+	return pictureType, picture
+}
+
+// readMP4 reads the iTunes metadata of an MP4 file from moov.udta.meta.ilst.
+func readMP4(r io.ReadSeeker) (Tags, []byte, error) {
+	for {
+		atomType, size, err := mp4Atom(r)
+		if err == io.EOF {
+			return Tags{}, nil, nil
+		} else if err != nil {
+			return Tags{}, nil, err
+		}
+		if atomType != "moov" {
+			if size < 0 {
+				return Tags{}, nil, nil
+			}
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return Tags{}, nil, err
+			}
+			continue
+		}
+		if size < 0 || size > maxTagSize {
+			return Tags{}, nil, errInvalidTag
+		}
+		moov := make([]byte, size)
+		if _, err := io.ReadFull(r, moov); err != nil {
+			return Tags{}, nil, err
+		}
+		ilst := mp4Child(mp4Child(mp4Child(moov, "udta"), "meta"), "ilst")
+		var tags Tags
+		var picture []byte
+		for items := ilst; len(items) >= 8; {
+			size := int(binary.BigEndian.Uint32(items))
+			if size < 8 || size > len(items) {
+				break
+			}
+			item, name := items[8:size], string(items[4:8])
+			items = items[size:]
+
+			data := mp4Child(item, "data")
+			if len(data) < 8 {
+				continue
+			}
+			value := data[8:] // After the type indicator and the locale.
+			switch name {
+			case "\xa9nam":
+				tags.Title = string(value)
+			case "\xa9ART":
+				tags.Artist = string(value)
+			case "\xa9alb":
+				tags.Album = string(value)
+			case "\xa9day":
+				tags.Year = year(string(value))
+			case "trkn":
+				if len(value) >= 4 {
+					tags.Track = int(binary.BigEndian.Uint16(value[2:]))
+				}
+			case "covr":
+				if picture == nil && len(value) > 0 {
+					picture = value
+				}
+			}
+		}
+		return tags, picture, nil
+	}
+}
+
+// mp4Atom reads the header of the next atom and returns its type and the size
+// of its contents, or -1 if it extends to the end of the file.
+func mp4Atom(r io.Reader) (string, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err == io.ErrUnexpectedEOF {
+		return "", 0, io.EOF
+	} else if err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	switch size {
+	case 0:
+		return string(header[4:]), -1, nil
+	case 1:
+		var large [8]byte
+		if _, err := io.ReadFull(r, large[:]); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(large[:])) - 16
+	default:
+		size -= 8
+	}
+	if size < 0 {
+		return "", 0, errInvalidTag
+	}
+	return string(header[4:]), size, nil
+}
+
+// mp4Child returns the contents of the first child atom of the type.
+func mp4Child(atoms []byte, atomType string) []byte {
+	for len(atoms) >= 8 {
+		size := int(binary.BigEndian.Uint32(atoms))
+		if size < 8 || size > len(atoms) {
+			return nil
+		}
+		if string(atoms[4:8]) == atomType {
+			contents := atoms[8:size]
+			if atomType == "meta" && len(contents) >= 4 && string(contents[4:min(8, len(contents))]) != "hdlr" {
+				// meta is a full atom with a version and flags,
+				// except in QuickTime files.
+				contents = contents[4:]
+			}
+			return contents
+		}
+		atoms = atoms[size:]
+	}
+	return nil
+}
+
+// trackNumber parses track numbers like "3" or "3/12".
+func trackNumber(s string) int {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// year returns the year of dates like "2019" or "2019-05-04".
+func year(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 4 {
+		return s[:4]
+	}
+	return s
+}
@@ -0,0 +1,216 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func id3Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	n := len(body)
+	header := []byte{'I', 'D', '3', version, 0, 0, byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+	return append(header, body...)
+}
+
+func id3Frame(version byte, id string, data ...byte) []byte {
+	n := len(data)
+	var header []byte
+	switch version {
+	case 2:
+		header = append([]byte(id), byte(n>>16), byte(n>>8), byte(n))
+	case 3:
+		header = binary.BigEndian.AppendUint32([]byte(id), uint32(n))
+		header = append(header, 0, 0)
+	case 4:
+		header = append([]byte(id), byte(n>>21&0x7f), byte(n>>14&0x7f), byte(n>>7&0x7f), byte(n&0x7f), 0, 0)
+	}
+	return append(header, data...)
+}
+
+func flacBlock(blockType byte, last bool, data []byte) []byte {
+	if last {
+		blockType |= 0x80
+	}
+	n := len(data)
+	return append([]byte{blockType, byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+}
+
+func vorbisCommentBlock(comments ...string) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, 6)
+	buf = append(buf, "vendor"...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(comments)))
+	for _, comment := range comments {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(comment)))
+		buf = append(buf, comment...)
+	}
+	return buf
+}
+
+func flacPictureBlock(pictureType uint32, picture string) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, pictureType)
+	buf = binary.BigEndian.AppendUint32(buf, 10)
+	buf = append(buf, "image/jpeg"...)
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = append(buf, make([]byte, 16)...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(picture)))
+	return append(buf, picture...)
+}
+
+func mp4Box(atomType string, contents ...[]byte) []byte {
+	body := bytes.Join(contents, nil)
+	buf := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	buf = append(buf, atomType...)
+	return append(buf, body...)
+}
+
+func mp4Item(name string, value []byte) []byte {
+	return mp4Box(name, mp4Box("data", make([]byte, 8), value))
+}
+
+func mp4File(ilst ...[]byte) []byte {
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		mp4Box("mdat", make([]byte, 100)),
+		mp4Box("moov", mp4Box("udta", mp4Box("meta", make([]byte, 4), mp4Box("ilst", ilst...)))),
+	}, nil)
+}
+
+var (
+	flacStreamInfo = flacBlock(0, false, make([]byte, 34))
+
+	id3v23 = id3Tag(3,
+		id3Frame(3, "TIT2", append([]byte{0}, "Caf\xe9"...)...),
+		id3Frame(3, "TPE1", append([]byte{0}, "Artist\x00"...)...),
+		id3Frame(3, "TALB", append([]byte{0}, "Album"...)...),
+		id3Frame(3, "TRCK", append([]byte{0}, "3/12"...)...),
+		id3Frame(3, "TYER", append([]byte{0}, "2019"...)...),
+		id3Frame(3, "APIC", append([]byte{0}, "image/jpeg\x00\x00back\x00BACK"...)...),
+		id3Frame(3, "APIC", append([]byte{0}, "image/jpeg\x00\x03front\x00FRONT"...)...),
+		id3Frame(3, "APIC", append([]byte{0}, "image/jpeg\x00\x04other\x00OTHER"...)...),
+	)
+	flac = bytes.Join([][]byte{
+		[]byte("fLaC"),
+		flacStreamInfo,
+		flacBlock(4, false, vorbisCommentBlock("title=Title", "ARTIST=Artist", "Album=Album", "TRACKNUMBER=7", "DATE=2019-05-04")),
+		flacBlock(6, true, flacPictureBlock(3, "FRONT")),
+	}, nil)
+	mp4 = mp4File(
+		mp4Item("\xa9nam", []byte("Title")),
+		mp4Item("\xa9ART", []byte("Artist")),
+		mp4Item("\xa9alb", []byte("Album")),
+		mp4Item("\xa9day", []byte("2019-05-04T00:00:00Z")),
+		mp4Item("trkn", []byte{0, 0, 0, 5, 0, 12, 0, 0}),
+		mp4Item("covr", []byte("COVER")),
+	)
+)
+
+func TestReadTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		tags    Tags
+		picture string
+	}{
+		{"empty", nil, Tags{}, ""},
+		{"short", []byte("abc"), Tags{}, ""},
+		{"other format", []byte("RIFF\x00\x00\x00\x00WAVEfmt "), Tags{}, ""},
+		{
+			"ID3v2.2",
+			id3Tag(2,
+				id3Frame(2, "TT2", append([]byte{0}, "Title"...)...),
+				id3Frame(2, "TP1", append([]byte{0}, "Artist"...)...),
+				id3Frame(2, "TRK", append([]byte{0}, "2"...)...),
+				id3Frame(2, "PIC", append([]byte{0}, "JPG\x03\x00PIC"...)...),
+			),
+			Tags{Title: "Title", Artist: "Artist", Track: 2},
+			"PIC",
+		},
+		{"ID3v2.3", id3v23, Tags{Title: "Café", Artist: "Artist", Album: "Album", Track: 3, Year: "2019"}, "FRONT"},
+		{
+			"ID3v2.4",
+			id3Tag(4,
+				id3Frame(4, "TIT2", append([]byte{3}, "Ünïcode"...)...),
+				id3Frame(4, "TPE1", 1, 0xff, 0xfe, 'A', 0, 'r', 0, 't', 0, 0, 0),
+				id3Frame(4, "TALB", 2, 0, 'A', 0, 'l', 0, 'b'),
+				id3Frame(4, "TDRC", append([]byte{0}, "2019-05-04"...)...),
+				// Padding.
+				make([]byte, 32),
+			),
+			Tags{Title: "Ünïcode", Artist: "Art", Album: "Alb", Year: "2019"},
+			"",
+		},
+		{
+			"ID3v2.4 oversized frame",
+			id3Tag(4,
+				id3Frame(4, "TIT2", append([]byte{0}, "Title"...)...),
+				[]byte{'T', 'P', 'E', '1', 0, 0, 0x7f, 0x7f, 0, 0, 0},
+			),
+			Tags{Title: "Title"},
+			"",
+		},
+		{"FLAC", flac, Tags{Title: "Title", Artist: "Artist", Album: "Album", Track: 7, Year: "2019"}, "FRONT"},
+		{"FLAC after ID3", append(id3Tag(3), flac...), Tags{Title: "Title", Artist: "Artist", Album: "Album", Track: 7, Year: "2019"}, "FRONT"},
+		{
+			"FLAC missing comments",
+			bytes.Join([][]byte{
+				[]byte("fLaC"),
+				// The comment count claims more comments than the
+				// block holds.
+				flacBlock(4, true, binary.LittleEndian.AppendUint32(vorbisCommentBlock("TITLE=Title")[:10], 5)),
+			}, nil),
+			Tags{},
+			"",
+		},
+		{"MP4", mp4, Tags{Title: "Title", Artist: "Artist", Album: "Album", Track: 5, Year: "2019"}, "COVER"},
+		{"MP4 without moov", mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00")), Tags{}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tags, picture, err := readTags(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatalf("readTags() returned %v", err)
+			}
+			if tags != test.tags {
+				t.Errorf("readTags() = %+v, want %+v", tags, test.tags)
+			}
+			if string(picture) != test.picture {
+				t.Errorf("readTags() picture = %q, want %q", picture, test.picture)
+			}
+		})
+	}
+}
+
+func TestReadTagsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"ID3 truncated", id3v23[:len(id3v23)-10]},
+		{"ID3 oversized", []byte("ID3\x03\x00\x00\x7f\x7f\x7f\x7f")},
+		{"ID3 unknown version", []byte("ID3\x05\x00\x00\x00\x00\x00\x00")},
+		{"ID3 oversized extended header", []byte("ID3\x03\x00\x40\x00\x00\x00\x04\x7f\xff\xff\xff")},
+		{"FLAC truncated", flac[:len(flac)-2]},
+		{"FLAC without last block", flac[:4+len(flacStreamInfo)]},
+		{"MP4 truncated", mp4[:len(mp4)-2]},
+		{"MP4 oversized moov", append(mp4Box("ftyp", []byte("M4A ")), 0x7f, 0xff, 0xff, 0xff, 'm', 'o', 'o', 'v')},
+		{"MP4 undersized atom", append(mp4Box("ftyp", []byte("M4A ")), 0, 0, 0, 4, 'f', 'r', 'e', 'e')},
+		{"MP4 large size", append(mp4Box("ftyp", []byte("M4A ")), 0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0, 0, 0, 0, 0, 0, 8)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := readTags(bytes.NewReader(test.data)); err == nil {
+				t.Error("readTags() did not return an error")
+			}
+		})
+	}
+}
+
+func FuzzReadTags(f *testing.F) {
+	for _, seed := range [][]byte{id3v23, flac, mp4, append(id3Tag(4), flac...)} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readTags(bytes.NewReader(data))
+	})
+}
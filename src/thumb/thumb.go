@@ -1,6 +1,7 @@
 package thumb
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -9,17 +10,49 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"reflect"
 	"time"
 
 	"webfs/src/cache"
+	"webfs/src/logging"
+	"webfs/src/metadata"
+	"webfs/src/metrics"
 )
 
-var thumbers []Thumber
+var logger = logging.Component("thumb")
+
+var (
+	thumbers []Thumber
+	disabled = map[string]error{}
+)
 
 func RegisterThumber(thumber Thumber) {
 	thumbers = append(thumbers, thumber)
 }
 
+// DisableThumber records that the named thumber is not available, e.g.
+// because a program it depends on is not installed.
+func DisableThumber(name string, reason error) {
+	logger.Warn("Disabling thumber", "thumber", name, "reason", reason)
+	disabled[name] = reason
+}
+
+// Thumbers returns the names of the registered thumbers in order of
+// precedence.
+func Thumbers() []string {
+	names := make([]string, len(thumbers))
+	for i, th := range thumbers {
+		names[i] = Name(th)
+	}
+	return names
+}
+
+// DisabledThumbers returns the names of the thumbers that are not available
+// along with the reason.
+func DisabledThumbers() map[string]error {
+	return disabled
+}
+
 type Thumber interface {
 	// Accepts checks wether the thumber is capable of creating a thumbnail of
 	// the specified file.
@@ -28,7 +61,58 @@ type Thumber interface {
 	Thumb(filename string, w, h int) (image.Image, error)
 }
 
+// Name identifies a thumber by the name of the package implementing it.
+func Name(thumber Thumber) string {
+	return path.Base(reflect.TypeOf(thumber).PkgPath())
+}
+
+// A FallbackThumber is a Thumber that can also create thumbnails of files
+// that it does not accept from other files, such as the cover image in the
+// directory of an audio file.
+type FallbackThumber interface {
+	Thumber
+	// AcceptsFallback checks whether the thumber is capable of creating a
+	// thumbnail of the specified file from other files. Unlike Accepts,
+	// its result is not cached until the file itself changes.
+	AcceptsFallback(filename string) (bool, error)
+}
+
+// A KeyedThumber is a Thumber whose thumbnails also depend on other files than
+// the one they are made of.
+type KeyedThumber interface {
+	Thumber
+	// CacheKey identifies the other files a thumbnail of the specified file
+	// is made of, e.g. by their modification time. Cached thumbnails with
+	// another key are made again.
+	CacheKey(filename string) (string, error)
+}
+
+// FindThumber returns the first thumber that accepts the file, or nil if none
+// does. The name of the thumber is cached in the shared metadata store. Files
+// no thumber accepts are offered to the fallback thumbers.
 func FindThumber(filename string) (Thumber, error) {
+	name, err := metadata.Lookup(metadata.Shared(), filename, "thumber", func(filename string) (string, error) {
+		th, err := findThumber(filename)
+		if th == nil {
+			return "", err
+		}
+		return Name(th), nil
+	})
+	if err != nil {
+		return nil, err
+	} else if name == "" {
+		return findFallbackThumber(filename)
+	}
+	for _, th := range thumbers {
+		if Name(th) == name {
+			return th, nil
+		}
+	}
+	// The thumber is no longer registered.
+	return findThumber(filename)
+}
+
+func findThumber(filename string) (Thumber, error) {
 	var aerr error
 	for _, th := range thumbers {
 		ok, err := th.Accepts(filename)
@@ -43,33 +127,77 @@ func FindThumber(filename string) (Thumber, error) {
 	return nil, aerr
 }
 
+func findFallbackThumber(filename string) (Thumber, error) {
+	var aerr error
+	for _, th := range thumbers {
+		fb, ok := th.(FallbackThumber)
+		if !ok {
+			continue
+		}
+		ok, err := fb.AcceptsFallback(filename)
+		if err != nil {
+			aerr = err
+			continue
+		}
+		if ok {
+			return th, nil
+		}
+	}
+	return nil, aerr
+}
+
 // This is the preferred way of creating a thumbnail. This function will manage
 // the cache set by SetCache() and update the thumbnail if the file
 // modification time changes.
 //
-// The thumbnail is exposed as a JPEG image.
-func ThumbFile(thumbCache cache.Cache, filename string, width, height int) (cache.ReadSeekCloser, time.Time, error) {
-	return cache.CacheFile(thumbCache, filename, cacheInstance(width, height), func(filename string, wr io.Writer) error {
-		th, err := FindThumber(filename)
+// The thumbnail is exposed as a JPEG image. Messages are logged with ctx, so
+// they can be related to the request that caused the thumbnail to be made.
+func ThumbFile(ctx context.Context, thumbCache cache.Cache, filename string, width, height int) (cache.ReadSeekCloser, time.Time, error) {
+	th, err := FindThumber(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	} else if th == nil {
+		return nil, time.Time{}, fmt.Errorf("no thumber to generate thumbnail for %q", filename)
+	}
+	instance := cacheInstance(width, height)
+	if keyed, ok := th.(KeyedThumber); ok {
+		key, err := keyed.CacheKey(filename)
 		if err != nil {
-			return err
-		} else if th == nil {
-			return fmt.Errorf("no thumber to generate thumbnail for %q", filename)
+			return nil, time.Time{}, err
+		}
+		if key != "" {
+			instance += "-" + key
 		}
+	}
+	return cache.CacheFile(thumbCache, filename, instance, func(filename string, wr io.Writer) error {
+		name := Name(th)
+		start := time.Now()
 		img, err := th.Thumb(filename, width, height)
+		duration := time.Since(start)
+		metrics.ThumbnailDuration.WithLabelValues(name).Observe(duration.Seconds())
 		if err != nil {
+			metrics.ThumbnailFailures.WithLabelValues(name).Inc()
+			logger.WarnContext(ctx, "Could not generate thumbnail", "thumber", name, "file", filename, "duration", duration, "err", err)
 			return err
 		}
+		metrics.ThumbnailsGenerated.WithLabelValues(name).Inc()
+		logger.DebugContext(ctx, "Generated thumbnail", "thumber", name, "file", filename, "duration", duration)
 		return jpeg.Encode(wr, img, nil)
 	})
 }
 
+// MimeType determines the type of a file by its extension, or by sniffing its
+// contents if the extension is not known. Sniffed types are cached in the
+// shared metadata store.
 func MimeType(filename string) (string, error) {
 	fileMime := mime.TypeByExtension(path.Ext(filename))
 	if fileMime != "" && fileMime != "application/octet-stream" {
 		return fileMime, nil
 	}
+	return metadata.Lookup(metadata.Shared(), filename, "mime", sniffMimeType)
+}
 
+func sniffMimeType(filename string) (string, error) {
 	fd, err := os.Open(filename)
 	if err != nil {
 		return "", err
@@ -77,7 +205,8 @@ func MimeType(filename string) (string, error) {
 	defer fd.Close()
 	var buf [512]byte
 	n, err := fd.Read(buf[:])
-	if err != nil {
+	// Empty files are detected as plain text.
+	if err != nil && err != io.EOF {
 		return "", err
 	}
 	return http.DetectContentType(buf[:n]), nil
@@ -4,7 +4,6 @@ import (
 	"image"
 	"image/png"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"strconv"
@@ -14,7 +13,7 @@ import (
 
 func init() {
 	if _, err := exec.LookPath("inkscape"); err != nil {
-		log.Printf("Disabling vector thumber: %v", err)
+		thumb.DisableThumber("vector", err)
 		return
 	}
 	thumb.RegisterThumber(VectorThumber{})
@@ -4,22 +4,22 @@ import (
 	"fmt"
 	"image"
 	"image/jpeg"
-	"log"
 	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 
+	"webfs/src/metrics"
 	"webfs/src/thumb"
 )
 
 func init() {
 	if _, err := exec.LookPath("ffmpeg"); err != nil {
-		log.Printf("Disabling video thumber: %v", err)
+		thumb.DisableThumber("video", err)
 		return
 	}
 	if _, err := exec.LookPath("ffprobe"); err != nil {
-		log.Printf("Disabling video thumber: %v", err)
+		thumb.DisableThumber("video", err)
 		return
 	}
 	thumb.RegisterThumber(FFmpegThumber{})
@@ -97,6 +97,9 @@ func (vt FFmpegThumber) Thumb(filename string, w, h int) (image.Image, error) {
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
+	active := metrics.ActiveTranscodes.WithLabelValues("ffmpeg")
+	active.Inc()
+	defer active.Dec()
 	image, err := jpeg.Decode(o)
 	if err != nil {
 		cmd.Wait()
@@ -116,7 +119,10 @@ func (FFmpegThumber) videoDuration(filename string) (time.Duration, error) {
 		filename,
 	)
 
+	active := metrics.ActiveTranscodes.WithLabelValues("ffprobe")
+	active.Inc()
 	out, err := cmd.Output()
+	active.Dec()
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"webfs/src/fs"
+	"webfs/src/thumb"
+)
+
+// A timelineMonth groups the photos taken in a month by day.
+type timelineMonth struct {
+	ID    string
+	Title string
+	Count int
+	Days  []timelineDay
+}
+
+type timelineDay struct {
+	Date   time.Time
+	Photos []timelinePhoto
+}
+
+type timelinePhoto struct {
+	// The position of the photo in the files passed to the embed view.
+	Index int
+	File  map[string]interface{}
+}
+
+// photoFile returns the properties of a photo that are passed to the embed
+// view and the templates of the photo pages.
+func photoFile(photo fs.Photo) map[string]interface{} {
+	th, _ := thumb.FindThumber(photo.Path)
+	return map[string]interface{}{
+		"name":     photo.Name(),
+		"path":     photo.RelPath,
+		"type":     photo.MimeType,
+		"hasThumb": th != nil,
+		"size":     photo.Info.Size(),
+		"modTime":  photo.Info.ModTime(),
+		"taken":    photo.Taken,
+	}
+}
+
+func (web *Web) timeline(w http.ResponseWriter, r *http.Request) {
+	path := r.Context().Value(pathContextKey).(string)
+
+	photos, err := web.fs.Timeline(r.Context(), path, web.authenticator.FSAuthenticator(r))
+	if err == fs.ErrFileDoesNotExist || err == fs.ErrNotDirectory {
+		http.NotFound(w, r)
+		return
+	} else if err == fs.ErrNeedAuthentication {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	} else if err == fs.ErrAccessDenied {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	} else if err != nil {
+		httpLogger.ErrorContext(r.Context(), "Could not build timeline", "path", path, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	files := make([]map[string]interface{}, len(photos))
+	var months []timelineMonth
+	for i, photo := range photos {
+		files[i] = photoFile(photo)
+
+		year, month, day := photo.Taken.Date()
+		if n := len(months); n == 0 || months[n-1].ID != photo.Taken.Format("2006-01") {
+			months = append(months, timelineMonth{
+				ID:    photo.Taken.Format("2006-01"),
+				Title: photo.Taken.Format("January 2006"),
+			})
+		}
+		m := &months[len(months)-1]
+		if n := len(m.Days); n == 0 || m.Days[n-1].Date.Day() != day {
+			m.Days = append(m.Days, timelineDay{Date: time.Date(year, month, day, 0, 0, 0, 0, photo.Taken.Location())})
+		}
+		d := &m.Days[len(m.Days)-1]
+		d.Photos = append(d.Photos, timelinePhoto{Index: i, File: files[i]})
+		m.Count++
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(files); err != nil {
+			httpLogger.ErrorContext(r.Context(), "Could not encode timeline", "path", path, "err", err)
+		}
+		return
+	}
+
+	args := web.baseTeplateArgs(r)
+	args["files"] = files
+	args["months"] = months
+	args["path"] = path
+	args["breadcrumbs"] = breadcrumbs(path)
+	args["slideshowInterval"] = web.config().UI.SlideshowInterval.Milliseconds()
+	args["title"] = "Timeline of " + filepath.Base(path)
+	if err := web.pageTemplate("timeline.html").Execute(w, args); err != nil {
+		panic(err)
+	}
+}
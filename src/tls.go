@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The files of a certReloader are checked for changes at most this often.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate and key pair from disk. The files are
+// loaded again when either of them changes, so renewed certificates are used
+// without restarting.
+type certReloader struct {
+	certFile, keyFile string
+
+	lock            sync.Mutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+	checked         time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (cr *certReloader) reload() error {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.certMod, cr.keyMod = certMod, keyMod
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	// Handshakes are too frequent to check the files every time.
+	now := time.Now()
+	if now.Sub(cr.checked) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checked = now
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		serverLogger.Error("Could not check TLS certificate", "err", err)
+		return cr.cert, nil
+	}
+	if !certMod.Equal(cr.certMod) || !keyMod.Equal(cr.keyMod) {
+		// The files may be replaced one after the other, in which case the
+		// pair does not match until both have been written. The previous
+		// certificate is served until then.
+		if err := cr.reload(); err != nil {
+			serverLogger.Error("Could not reload TLS certificate", "err", err)
+		} else {
+			serverLogger.Info("Reloaded TLS certificate", "file", cr.certFile)
+		}
+	}
+	return cr.cert, nil
+}
+
+// newACMEManager creates a manager that obtains certificates for the
+// configured domains from an ACME CA, Let's Encrypt by default. Certificates
+// and the account key are stored in cacheDir.
+func newACMEManager(conf ACMEConfig, cacheDir string) (*autocert.Manager, error) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.Domains...),
+		Email:      conf.Email,
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	if conf.Directory == "" && conf.DirectoryCA == "" {
+		return manager, nil
+	}
+
+	client := &acme.Client{DirectoryURL: conf.Directory}
+	if conf.DirectoryCA != "" {
+		pem, err := ioutil.ReadFile(conf.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", conf.DirectoryCA)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+	manager.Client = client
+	return manager, nil
+}
+
+// redirectHTTPS redirects all requests to the same URL using HTTPS on the
+// specified port.
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"webfs/src/fs"
+	"webfs/src/metrics"
+)
+
+// TokenOp is an operation that an API token may be allowed to perform.
+type TokenOp string
+
+const (
+	// OpList permits browsing directories through /view and /thumb.
+	OpList TokenOp = "list"
+	// OpGet permits fetching files through /get.
+	OpGet TokenOp = "get"
+	// OpDownload permits downloading archives through /download.
+	OpDownload TokenOp = "download"
+)
+
+var tokenOps = []TokenOp{OpList, OpGet, OpDownload}
+
+func parseTokenOps(s string) ([]TokenOp, error) {
+	var ops []TokenOp
+outer:
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		for _, op := range tokenOps {
+			if string(op) == name {
+				ops = append(ops, op)
+				continue outer
+			}
+		}
+		return nil, fmt.Errorf("unknown token operation %q", name)
+	}
+	return ops, nil
+}
+
+// operationCtx records the operation performed by the routes it wraps so
+// authenticators can check the scope of API tokens.
+func operationCtx(op TokenOp) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), operationContextKey, op)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func requestOperation(r *http.Request) TokenOp {
+	op, _ := r.Context().Value(operationContextKey).(TokenOp)
+	return op
+}
+
+// A Token grants bearer access to all files below a path prefix for a set of
+// operations. Only a hash of the secret is stored.
+type Token struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Prefix  string    `json:"prefix"`
+	Ops     []TokenOp `json:"ops"`
+	Created time.Time `json:"created"`
+	// The token is no longer accepted from this time on. The zero time
+	// means the token does not expire.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Expired reports whether the token is no longer valid at the time now.
+func (tok *Token) Expired(now time.Time) bool {
+	return !tok.Expires.IsZero() && !now.Before(tok.Expires)
+}
+
+// Allows checks whether the token may perform op on the file at path, which
+// is relative to the root of the filesystem.
+func (tok *Token) Allows(path string, op TokenOp) bool {
+	prefix := strings.TrimSuffix(tok.Prefix, "/")
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return false
+	}
+	for _, o := range tok.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenStore keeps API tokens in a JSON file. The file is reloaded when it is
+// modified so tokens created or revoked from the command line take effect
+// without restarting the daemon.
+type TokenStore struct {
+	filename string
+
+	lock    sync.Mutex
+	tokens  map[string]Token
+	modTime time.Time
+}
+
+func NewTokenStore(filename string) (*TokenStore, error) {
+	store := &TokenStore{filename: filename}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reload reads the token file if it has changed. The caller must hold the lock
+// or have exclusive access to the store.
+func (store *TokenStore) reload() error {
+	info, err := os.Stat(store.filename)
+	if os.IsNotExist(err) {
+		store.tokens = map[string]Token{}
+		store.modTime = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if store.tokens != nil && info.ModTime().Equal(store.modTime) {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(store.filename)
+	if err != nil {
+		return err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(buf, &tokens); err != nil {
+		return fmt.Errorf("token file %q is not valid: %v", store.filename, err)
+	}
+	store.tokens = make(map[string]Token, len(tokens))
+	for _, tok := range tokens {
+		store.tokens[tok.ID] = tok
+	}
+	store.modTime = info.ModTime()
+	return nil
+}
+
+func (store *TokenStore) save() error {
+	tokens := make([]Token, 0, len(store.tokens))
+	for _, tok := range store.tokens {
+		tokens = append(tokens, tok)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	buf, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(store.filename), 0700); err != nil {
+		return err
+	}
+	tmp := store.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, store.filename); err != nil {
+		return err
+	}
+	if info, err := os.Stat(store.filename); err == nil {
+		store.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Create generates a new token and returns its secret value. The secret can
+// not be recovered later. A zero expires creates a token that does not expire.
+func (store *TokenStore) Create(name, prefix string, ops []TokenOp, expires time.Time) (string, Token, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := store.reload(); err != nil {
+		return "", Token{}, err
+	}
+
+	var id [8]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", Token{}, err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", Token{}, err
+	}
+	raw := hex.EncodeToString(id[:]) + "." + hex.EncodeToString(secret[:])
+
+	tok := Token{
+		ID:      hex.EncodeToString(id[:]),
+		Name:    name,
+		Hash:    hashToken(raw),
+		Prefix:  filepath.Clean("/" + prefix),
+		Ops:     ops,
+		Created: time.Now(),
+		Expires: expires,
+	}
+	store.tokens[tok.ID] = tok
+	if err := store.save(); err != nil {
+		return "", Token{}, err
+	}
+	return raw, tok, nil
+}
+
+func (store *TokenStore) Revoke(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := store.reload(); err != nil {
+		return err
+	}
+	if _, ok := store.tokens[id]; !ok {
+		return fmt.Errorf("no such token: %q", id)
+	}
+	delete(store.tokens, id)
+	return store.save()
+}
+
+func (store *TokenStore) List() ([]Token, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	tokens := make([]Token, 0, len(store.tokens))
+	for _, tok := range store.tokens {
+		tokens = append(tokens, tok)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens, nil
+}
+
+// Lookup returns the token matching the raw secret or nil if it does not
+// exist, has been revoked or has expired.
+func (store *TokenStore) Lookup(raw string) (*Token, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+
+	i := strings.IndexByte(raw, '.')
+	if i < 0 {
+		return nil, nil
+	}
+	tok, ok := store.tokens[raw[:i]]
+	if !ok {
+		return nil, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(tok.Hash), []byte(hashToken(raw))) != 1 {
+		return nil, nil
+	}
+	if tok.Expired(time.Now()) {
+		return nil, nil
+	}
+	return &tok, nil
+}
+
+// TokenAuthenticator grants access to requests bearing a valid API token and
+// defers all other requests to the wrapped Authenticator.
+type TokenAuthenticator struct {
+	Authenticator
+	filesystem *fs.Filesystem
+	tokens     *TokenStore
+}
+
+func NewTokenAuthenticator(auth Authenticator, filesystem *fs.Filesystem, tokens *TokenStore) *TokenAuthenticator {
+	return &TokenAuthenticator{
+		Authenticator: auth,
+		filesystem:    filesystem,
+		tokens:        tokens,
+	}
+}
+
+// requestToken looks up the bearer token of a request. The returned bool is
+// false if the request does not carry a token at all; the returned token is
+// nil if the presented token is not valid.
+func (auth *TokenAuthenticator) requestToken(r *http.Request) (*Token, bool, error) {
+	// The scheme is case insensitive, see RFC 7235 section 2.1.
+	scheme, raw, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, false, nil
+	}
+	tok, err := auth.tokens.Lookup(strings.TrimSpace(raw))
+	return tok, true, err
+}
+
+func (auth *TokenAuthenticator) relPath(filename string) string {
+	return filepath.Clean("/" + strings.TrimPrefix(filename, auth.filesystem.Mount()))
+}
+
+// accessChecker is implemented by Authenticators that enforce .access.txt.
+type accessChecker interface {
+	checkAccess(filename string, r *http.Request) (accessDecision, error)
+}
+
+// checkAccess applies the .access.txt of the wrapped Authenticator, tokens do
+// not lift the restrictions on client addresses.
+func (auth *TokenAuthenticator) checkAccess(filename string, r *http.Request) (accessDecision, error) {
+	if checker, ok := auth.Authenticator.(accessChecker); ok {
+		return checker.checkAccess(filename, r)
+	}
+	return accessNeedPassword, nil
+}
+
+func (auth *TokenAuthenticator) Authenticate(filename string, w http.ResponseWriter, r *http.Request) (bool, error) {
+	tok, present, err := auth.requestToken(r)
+	if err != nil {
+		return false, err
+	}
+	if !present {
+		return auth.Authenticator.Authenticate(filename, w, r)
+	}
+	if access, err := auth.checkAccess(filename, r); err != nil {
+		return false, err
+	} else if access == accessDenied {
+		w.WriteHeader(http.StatusForbidden)
+		return false, nil
+	}
+	if tok == nil {
+		auditAuthFailed(r, "")
+		metrics.AuthFailures.WithLabelValues("token").Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false, nil
+	}
+	auditToken(r, tok)
+	if tok.Allows(auth.relPath(filename), requestOperation(r)) {
+		return true, nil
+	}
+
+	// The token does not cover this file, but the file may not need any
+	// credentials at all.
+	if err := auth.Authenticator.FSAuthenticator(r).IsAuthenticated(filename); err == nil {
+		return true, nil
+	} else if err != fs.ErrNeedAuthentication && err != fs.ErrAccessDenied {
+		return false, err
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+	w.WriteHeader(http.StatusForbidden)
+	return false, nil
+}
+
+func (auth *TokenAuthenticator) FSAuthenticator(r *http.Request) fs.Authenticator {
+	next := auth.Authenticator.FSAuthenticator(r)
+	tok, present, err := auth.requestToken(r)
+	if !present {
+		return next
+	}
+	op := requestOperation(r)
+	// Listings check every file they show, the token is only audited once.
+	var audit sync.Once
+	return fs.AuthenticatorFunc(func(filename string) error {
+		if err != nil {
+			return err
+		}
+		if access, err := auth.checkAccess(filename, r); err != nil {
+			return err
+		} else if access == accessDenied {
+			return fs.ErrAccessDenied
+		}
+		if tok == nil {
+			audit.Do(func() { auditAuthFailed(r, "") })
+			return fs.ErrNeedAuthentication
+		}
+		audit.Do(func() { auditToken(r, tok) })
+		if tok.Allows(auth.relPath(filename), op) {
+			return nil
+		}
+		// Files the token does not cover are still accessible if they
+		// need no credentials. Asking for a password would hide that the
+		// token itself was accepted.
+		if err := next.IsAuthenticated(filename); err != fs.ErrNeedAuthentication {
+			return err
+		}
+		return fs.ErrAccessDenied
+	})
+}
+
+// tokenCommand implements the "token" subcommand for managing API tokens.
+func tokenCommand(store *TokenStore, args []string) error {
+	usage := fmt.Errorf("usage: webfs token create|list|revoke")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("token create", flag.ExitOnError)
+		name := flags.String("name", "", "A description of the token")
+		prefix := flags.String("prefix", "/", "The path below which the token grants access")
+		opsFlag := flags.String("ops", "list,get,download", "Comma separated operations the token may perform: list, get, download")
+		expiresIn := flags.Duration("expires", 0, "How long the token is valid, it does not expire if 0")
+		flags.Parse(args[1:])
+
+		ops, err := parseTokenOps(*opsFlag)
+		if err != nil {
+			return err
+		}
+		var expires time.Time
+		if *expiresIn > 0 {
+			expires = time.Now().Add(*expiresIn)
+		}
+		raw, tok, err := store.Create(*name, *prefix, ops, expires)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created token %s for %s, it will not be shown again:\n", tok.ID, tok.Prefix)
+		fmt.Println(raw)
+
+	case "list":
+		tokens, err := store.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tOPS\tCREATED\tEXPIRES")
+		for _, tok := range tokens {
+			ops := make([]string, len(tok.Ops))
+			for i, op := range tok.Ops {
+				ops[i] = string(op)
+			}
+			expires := "never"
+			if !tok.Expires.IsZero() {
+				expires = tok.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", tok.ID, tok.Name, tok.Prefix, strings.Join(ops, ","), tok.Created.Format(time.RFC3339), expires)
+		}
+		return tw.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: webfs token revoke <id>")
+		}
+		return store.Revoke(args[1])
+
+	default:
+		return usage
+	}
+	return nil
+}
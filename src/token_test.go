@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"webfs/src/fs"
+)
+
+func TestTokenAllows(t *testing.T) {
+	tests := []struct {
+		prefix string
+		ops    []TokenOp
+		path   string
+		op     TokenOp
+		want   bool
+	}{
+		{"/builds", []TokenOp{OpGet}, "/builds/a.tar.gz", OpGet, true},
+		{"/builds", []TokenOp{OpGet}, "/builds", OpGet, true},
+		{"/builds/", []TokenOp{OpGet}, "/builds/nested/a.tar.gz", OpGet, true},
+		// Prefixes match whole path components.
+		{"/builds", []TokenOp{OpGet}, "/builds-old/a.tar.gz", OpGet, false},
+		{"/builds", []TokenOp{OpGet}, "/", OpGet, false},
+		{"/", []TokenOp{OpGet}, "/builds/a.tar.gz", OpGet, true},
+		// Only the listed operations are permitted.
+		{"/builds", []TokenOp{OpGet}, "/builds/a.tar.gz", OpDownload, false},
+		{"/builds", []TokenOp{OpList, OpDownload}, "/builds", OpDownload, true},
+		{"/builds", nil, "/builds/a.tar.gz", OpList, false},
+	}
+	for _, test := range tests {
+		tok := Token{Prefix: test.prefix, Ops: test.ops}
+		if got := tok.Allows(test.path, test.op); got != test.want {
+			t.Errorf("Token{Prefix: %q, Ops: %v}.Allows(%q, %q) = %v, want %v", test.prefix, test.ops, test.path, test.op, got, test.want)
+		}
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := NewTokenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := store.Create("ci", "builds", []TokenOp{OpGet}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedToken, err := store.Create("old", "/", []TokenOp{OpGet}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Revoke(revokedToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := store.Create("expired", "/", []TokenOp{OpGet}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, _, err := store.Create("expiring", "/", []TokenOp{OpGet}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tokens are read back from the file by a fresh store.
+	reopened, err := NewTokenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		raw  string
+		name string
+	}{
+		{valid, "ci"},
+		{expiring, "expiring"},
+		{revoked, ""},
+		{expired, ""},
+		{valid[:len(valid)-1] + "0", ""},
+		{"no-separator", ""},
+		{"", ""},
+	}
+	for _, s := range []*TokenStore{store, reopened} {
+		for _, test := range tests {
+			tok, err := s.Lookup(test.raw)
+			if err != nil {
+				t.Fatalf("Lookup(%q): %v", test.raw, err)
+			}
+			var name string
+			if tok != nil {
+				name = tok.Name
+			}
+			if name != test.name {
+				t.Errorf("Lookup(%q) = %q, want %q", test.raw, name, test.name)
+			}
+		}
+	}
+	if tok, _ := reopened.Lookup(valid); tok == nil || tok.Prefix != "/builds" {
+		t.Errorf("Lookup(valid) = %+v, want the prefix to be cleaned", tok)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	mount := t.TempDir()
+	for name, contents := range map[string]string{
+		"builds/.passwd.txt": "jane secret",
+		"builds/a.txt":       "artifact",
+		"public/p.txt":       "public",
+	} {
+		filename := filepath.Join(mount, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filesystem, err := fs.NewFilesystem(mount, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic, err := NewBasicAuthenticator(filesystem, t.TempDir(), TrustedProxies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	getToken, _, err := store.Create("ci", "/builds", []TokenOp{OpGet}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken, _, err := store.Create("ci", "/builds", []TokenOp{OpGet}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewTokenAuthenticator(basic, filesystem, store)
+
+	tests := []struct {
+		authorization string
+		path          string
+		op            TokenOp
+		status        int
+		fsErr         error
+	}{
+		{"Bearer " + getToken, "builds/a.txt", OpGet, http.StatusOK, nil},
+		{"bearer " + getToken, "builds/a.txt", OpGet, http.StatusOK, nil},
+		{"BEARER  " + getToken, "builds/a.txt", OpGet, http.StatusOK, nil},
+		// A valid token that lacks the operation is forbidden rather than
+		// asked for a password.
+		{"Bearer " + getToken, "builds/a.txt", OpDownload, http.StatusForbidden, fs.ErrAccessDenied},
+		// Files that need no credentials stay accessible.
+		{"Bearer " + getToken, "public/p.txt", OpDownload, http.StatusOK, nil},
+		{"Bearer " + expiredToken, "builds/a.txt", OpGet, http.StatusUnauthorized, fs.ErrNeedAuthentication},
+		{"Bearer nope.nope", "builds/a.txt", OpGet, http.StatusUnauthorized, fs.ErrNeedAuthentication},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", test.authorization)
+		r = r.WithContext(context.WithValue(r.Context(), operationContextKey, test.op))
+		filename := filepath.Join(mount, test.path)
+
+		w := httptest.NewRecorder()
+		ok, err := auth.Authenticate(filename, w, r)
+		if err != nil {
+			t.Fatalf("Authenticate(%q) with %q: %v", test.path, test.op, err)
+		}
+		if ok != (test.status == http.StatusOK) || w.Code != test.status {
+			t.Errorf("Authenticate(%q) with %q = %v, %d, want %d", test.path, test.op, ok, w.Code, test.status)
+		}
+		if err := auth.FSAuthenticator(r).IsAuthenticated(filename); err != test.fsErr {
+			t.Errorf("IsAuthenticated(%q) with %q = %v, want %v", test.path, test.op, err, test.fsErr)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// A directory that has a .totp.txt file next to its .passwd.txt requires
+	// users to enter a time based one time password after their credentials.
+	totpFileName = ".totp.txt"
+
+	totpPeriod        = 30 * time.Second
+	totpDigits        = 6
+	numRecoveryCodes  = 8
+	totpQRCodePxWidth = 256
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// SecondFactorRequired is returned by an Authenticator when the credentials of
+// the first factor were accepted, but the user still has to enter a TOTP code.
+type SecondFactorRequired struct {
+	User string
+	// Enrollment is set if the user has not yet configured an authenticator
+	// app for the protected directory.
+	Enrollment *TOTPEnrollment
+}
+
+func (err *SecondFactorRequired) Error() string {
+	return fmt.Sprintf("a second factor is required for user %q", err.User)
+}
+
+// TOTPEnrollment holds the data a user needs to set up their authenticator
+// app. It is only shown once.
+type TOTPEnrollment struct {
+	Secret        string
+	URL           string
+	QRCode        template.URL
+	RecoveryCodes []string
+}
+
+func newTOTPEnrollment(issuer, account, secret string, recoveryCodes []string) (*TOTPEnrollment, error) {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(int(totpPeriod / time.Second))},
+		}.Encode(),
+	}
+	png, err := qrcode.Encode(u.String(), qrcode.Medium, totpQRCodePxWidth)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret:        secret,
+		URL:           u.String(),
+		QRCode:        template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+type totpUser struct {
+	Secret string
+	// Recovery holds the hashes of the recovery codes that have not been
+	// used yet.
+	Recovery []string
+	// LastCounter is the time step of the last accepted code, codes of this
+	// or earlier steps can not be used again.
+	LastCounter uint64
+}
+
+// totpLocks serializes the updates of each .totp.txt, which are read, modified
+// and written back.
+var totpLocks sync.Map
+
+// lockTOTPFile locks the specified .totp.txt until the returned function is
+// called.
+func lockTOTPFile(filename string) (unlock func()) {
+	lock, _ := totpLocks.LoadOrStore(filename, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+func totpFile(passwdFile string) string {
+	return filepath.Join(filepath.Dir(passwdFile), totpFileName)
+}
+
+func requiresTOTP(passwdFile string) (bool, error) {
+	if _, err := os.Stat(totpFile(passwdFile)); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readTOTPFile parses a .totp.txt. Every line holds a username, the base32
+// encoded secret, a comma separated list of hashed recovery codes or "-" if
+// there are none left and the time step of the last accepted code. The last
+// two fields are optional.
+func readTOTPFile(filename string) (map[string]*totpUser, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening totp file: %v", err)
+	}
+	defer fd.Close()
+
+	users := map[string]*totpUser{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("totp file %q is not valid", filename)
+		}
+		user := &totpUser{Secret: fields[1]}
+		if len(fields) >= 3 && fields[2] != "-" {
+			user.Recovery = strings.Split(fields[2], ",")
+		}
+		if len(fields) == 4 {
+			if user.LastCounter, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+				return nil, fmt.Errorf("totp file %q is not valid", filename)
+			}
+		}
+		users[fields[0]] = user
+	}
+	return users, scanner.Err()
+}
+
+// writeTOTPFile replaces the contents of a .totp.txt. The caller must hold the
+// lock of the file.
+func writeTOTPFile(filename string, users map[string]*totpUser) error {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	for _, name := range names {
+		user := users[name]
+		recovery := "-"
+		if len(user.Recovery) > 0 {
+			recovery = strings.Join(user.Recovery, ",")
+		}
+		fmt.Fprintf(&buf, "%s %s %s %d\n", name, user.Secret, recovery, user.LastCounter)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), totpFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(buf.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func generateTOTPSecret() (string, error) {
+	var secret [20]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret[:]), nil
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, numRecoveryCodes)
+	for i := range codes {
+		var b [5]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b[:])
+		codes[i] = h[:5] + "-" + h[5:]
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode checks whether code is one of the remaining recovery codes of
+// the user and invalidates it if so.
+func (user *totpUser) useRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for i, h := range user.Recovery {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			user.Recovery = append(user.Recovery[:i], user.Recovery[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// totpCode computes the code for a time step as specified by RFC 4226 and RFC
+// 6238.
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks the code against the current time step and its direct
+// neighbours to allow for some clock skew. Only time steps after last are
+// accepted, so a code can not be replayed. It returns the time step of the
+// code.
+func verifyTOTP(secret, code string, last uint64, now time.Time) (uint64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	counter := uint64(now.Unix()) / uint64(totpPeriod/time.Second)
+	for _, c := range []uint64{counter - 1, counter, counter + 1} {
+		if c <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
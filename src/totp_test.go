@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238 appendix B, truncated to six digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		counter := uint64(test.time) / uint64(totpPeriod/time.Second)
+		if code := totpCode(secret, counter); code != test.code {
+			t.Errorf("totpCode(%d) = %q, want %q", test.time, code, test.code)
+		}
+	}
+}
+
+func TestVerifyTOTPReplay(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	counter, ok := verifyTOTP(secret, "081804", 0, now)
+	if !ok {
+		t.Fatal("valid code was rejected")
+	}
+	if _, ok := verifyTOTP(secret, "081804", counter, now); ok {
+		t.Fatal("code was accepted twice")
+	}
+	if _, ok := verifyTOTP(secret, "081804", 0, now.Add(2*totpPeriod)); ok {
+		t.Fatal("expired code was accepted")
+	}
+}
+
+func TestTOTPFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), totpFileName)
+	users := map[string]*totpUser{
+		"jane": {Secret: "SECRET", Recovery: []string{"a", "b"}, LastCounter: 42},
+		"john": {Secret: "OTHER"},
+	}
+	if err := writeTOTPFile(filename, users); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readTOTPFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jane := read["jane"]; jane == nil || jane.Secret != "SECRET" || len(jane.Recovery) != 2 || jane.LastCounter != 42 {
+		t.Errorf("jane = %+v", jane)
+	}
+	if john := read["john"]; john == nil || john.Secret != "OTHER" || len(john.Recovery) != 0 || john.LastCounter != 0 {
+		t.Errorf("john = %+v", john)
+	}
+
+	// Files written before the last accepted time step was stored.
+	if err := os.WriteFile(filename, []byte("jane SECRET a,b\njohn OTHER\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if read, err = readTOTPFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if jane := read["jane"]; jane == nil || len(jane.Recovery) != 2 || jane.LastCounter != 0 {
+		t.Errorf("jane = %+v", jane)
+	}
+}